@@ -0,0 +1,47 @@
+package dataloadgen
+
+import "context"
+
+// Chain creates a loader that loads a V1 by key with first, derives a key for second from it with
+// next and returns the V2 that second loads for that key, for example an organization by user ID.
+// Keys of the chained loader are batched and cached like those of any other loader, and the keys
+// it sends to first and second are batched together with those of their other callers.
+// An error from either loader is returned for the key.
+func Chain[K1 comparable, V1 any, K2 comparable, V2 any](first *Loader[K1, V1], next func(V1) K2, second *Loader[K2, V2], options ...Option) *Loader[K1, V2] {
+	return NewLoader(func(ctx context.Context, keys []K1) ([]V2, []error) {
+		values := make([]V2, len(keys))
+		errs := make([]error, len(keys))
+		thunks := make([]func() (V2, error), len(keys))
+		for i, result := range first.LoadAllResults(ctx, keys) {
+			if result.Err != nil {
+				errs[i] = result.Err
+				continue
+			}
+			thunks[i] = second.LoadThunk(ctx, next(result.Value))
+		}
+		for i, thunk := range thunks {
+			if thunk != nil {
+				values[i], errs[i] = thunk()
+			}
+		}
+		return values, errs
+	}, options...)
+}
+
+// LinkLoaders sets every value that from loads in to, using keyOf to get the value's key in to.
+// This keeps loaders of the same values by different keys, like users by ID and by email, from
+// fetching the same values again and from disagreeing about them. Link the loaders both ways to
+// set values in both directions.
+// If the loaders use WithBatchPartition, values are only set in the partition they were loaded
+// for, so both loaders must use the same partition function. LinkLoaders panics if only one of
+// them is partitioned.
+func LinkLoaders[K1 comparable, K2 comparable, ValueT any](from *Loader[K1, ValueT], to *Loader[K2, ValueT], keyOf func(ValueT) K2) {
+	if (from.partition == nil) != (to.partition == nil) {
+		panic("dataloadgen: LinkLoaders can't link a partitioned loader with one that isn't partitioned")
+	}
+	from.mu.Lock()
+	from.onResult = append(from.onResult, func(partition any, _ K1, value ValueT) {
+		to.setPartition(partition, keyOf(value), value)
+	})
+	from.mu.Unlock()
+}
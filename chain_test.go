@@ -0,0 +1,211 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+type user struct {
+	ID    string
+	OrgID int
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	var userFetches, orgFetches int
+	var mu sync.Mutex
+	users := dataloadgen.NewMappedLoader(func(_ context.Context, ids []string) (map[string]user, error) {
+		mu.Lock()
+		userFetches++
+		mu.Unlock()
+		ret := map[string]user{}
+		for i, id := range ids {
+			if id != "missing" {
+				ret[id] = user{ID: id, OrgID: i % 2}
+			}
+		}
+		return ret, nil
+	}, dataloadgen.WithWait(time.Millisecond))
+	orgs := dataloadgen.NewLoader(func(_ context.Context, ids []int) ([]string, []error) {
+		mu.Lock()
+		orgFetches++
+		mu.Unlock()
+		ret := make([]string, len(ids))
+		for i, id := range ids {
+			ret[i] = []string{"even", "odd"}[id]
+		}
+		return ret, nil
+	}, dataloadgen.WithWait(time.Millisecond))
+	orgsByUser := dataloadgen.Chain(users, func(u user) int { return u.OrgID }, orgs, dataloadgen.WithWait(10*time.Millisecond))
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"a", "b", "c"} {
+		id := id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := orgsByUser.Load(ctx, id); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	_, err := orgsByUser.Load(ctx, "missing")
+	wg.Wait()
+	if !errors.Is(err, dataloadgen.ErrNotFound) {
+		t.Fatal("wrong error", err)
+	}
+
+	mu.Lock()
+	if userFetches != 1 || orgFetches != 1 {
+		t.Fatalf("batches not coalesced: %d user fetches, %d org fetches", userFetches, orgFetches)
+	}
+	mu.Unlock()
+
+	org, err := orgsByUser.Load(ctx, "a")
+	if err != nil || (org != "even" && org != "odd") {
+		t.Fatalf("wrong value/err: %v %v", org, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if userFetches != 1 || orgFetches != 1 {
+		t.Fatal("chained result not cached")
+	}
+}
+
+type account struct {
+	ID    int
+	Email string
+}
+
+func TestLinkLoaders(t *testing.T) {
+	ctx := context.Background()
+	accounts := []account{{1, "a@example.com"}, {2, "b@example.com"}}
+	var fetches int
+	var mu sync.Mutex
+	byID := dataloadgen.NewMappedLoader(func(_ context.Context, ids []int) (map[int]account, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		ret := map[int]account{}
+		for _, a := range accounts {
+			ret[a.ID] = a
+		}
+		return ret, nil
+	})
+	byEmail := dataloadgen.NewMappedLoader(func(_ context.Context, emails []string) (map[string]account, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		ret := map[string]account{}
+		for _, a := range accounts {
+			ret[a.Email] = a
+		}
+		return ret, nil
+	})
+	dataloadgen.LinkLoaders(byID, byEmail, func(a account) string { return a.Email })
+	dataloadgen.LinkLoaders(byEmail, byID, func(a account) int { return a.ID })
+
+	if _, err := byID.Load(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := byEmail.Load(ctx, "a@example.com"); err != nil || a.ID != 1 {
+		t.Fatalf("wrong value/err: %v %v", a, err)
+	}
+	if _, err := byEmail.Load(ctx, "b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := byID.Load(ctx, 2); err != nil || a.Email != "b@example.com" {
+		t.Fatalf("wrong value/err: %v %v", a, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Fatal("linked loaders weren't primed", fetches)
+	}
+}
+
+func TestWithOnResult(t *testing.T) {
+	var loaded []int
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]int, []error) {
+		errs := make([]error, len(keys))
+		for i, key := range keys {
+			if key < 0 {
+				errs[i] = errors.New("negative")
+			}
+		}
+		return keys, errs
+	},
+		dataloadgen.WithOnResult(func(key, value int) {
+			loaded = append(loaded, value)
+		}),
+	)
+	dl.LoadAll(context.Background(), []int{1, -1})
+	if len(loaded) != 1 || loaded[0] != 1 {
+		t.Fatal("wrong results reported", loaded)
+	}
+}
+
+func TestLinkLoadersPartitioned(t *testing.T) {
+	tenant := dataloadgen.WithBatchPartition(func(ctx context.Context) any { return ctx.Value(ctxKey{}) })
+	// each tenant has its own account 1, named after the tenant
+	byID := dataloadgen.NewLoader(func(ctx context.Context, ids []int) ([]account, []error) {
+		ret := make([]account, len(ids))
+		for i, id := range ids {
+			ret[i] = account{id, ctx.Value(ctxKey{}).(string) + "-secret"}
+		}
+		return ret, nil
+	}, tenant)
+	byName := dataloadgen.NewLoader(func(ctx context.Context, names []string) ([]account, []error) {
+		return make([]account, len(names)), []error{dataloadgen.ErrNotFound}
+	}, tenant)
+	dataloadgen.LinkLoaders(byID, byName, func(a account) string { return a.Email })
+
+	ctxA := context.WithValue(context.Background(), ctxKey{}, "a")
+	ctxB := context.WithValue(context.Background(), ctxKey{}, "b")
+	if _, err := byID.Load(ctxA, 1); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := byName.Load(ctxA, "a-secret"); err != nil || a.ID != 1 {
+		t.Fatalf("wrong value/err: %v %v", a, err)
+	}
+	if a, err := byName.Load(ctxB, "a-secret"); !errors.Is(err, dataloadgen.ErrNotFound) {
+		t.Fatalf("value leaked to another partition: %v %v", a, err)
+	}
+
+	unpartitioned := dataloadgen.NewLoader(func(ctx context.Context, names []string) ([]account, []error) {
+		return make([]account, len(names)), nil
+	})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	dataloadgen.LinkLoaders(byID, unpartitioned, func(a account) string { return a.Email })
+}
+
+func TestLinkLoadersReplacesCachedValues(t *testing.T) {
+	ctx := context.Background()
+	byID := dataloadgen.NewLoader(func(_ context.Context, ids []int) ([]account, []error) {
+		return []account{{ids[0], "a@example.com"}}, nil
+	})
+	byEmail := dataloadgen.NewLoader(func(_ context.Context, emails []string) ([]account, []error) {
+		return []account{{1, emails[0]}}, nil
+	})
+	dataloadgen.LinkLoaders(byID, byEmail, func(a account) string { return a.Email })
+
+	if a, err := byEmail.Load(ctx, "a@example.com"); err != nil || a.ID != 1 {
+		t.Fatalf("wrong value/err: %v %v", a, err)
+	}
+	if _, err := byID.Load(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := byEmail.Load(ctx, "a@example.com"); err != nil || a.ID != 2 {
+		t.Fatalf("linked loaders disagree: %v %v", a, err)
+	}
+}
@@ -0,0 +1,127 @@
+package dataloadgen
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// mergedContext carries the values of the first context and is only done once all of the
+// contexts it was created from are done, or once it's released.
+type mergedContext struct {
+	// the first context provides values
+	context.Context
+
+	deadline    time.Time
+	hasDeadline bool
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// callerContexts collects the contexts of the callers of a batch or an entry. Contexts are told apart
+// by their Done channels rather than compared directly, since not every context is comparable, and
+// contexts that share a Done channel are done together anyway.
+type callerContexts struct {
+	ctxs []context.Context
+	// the Done channels of ctxs, only tracked once there's more than one caller
+	seen map[<-chan struct{}]struct{}
+}
+
+// add collects ctx, unless a context with the same Done channel was collected already
+func (c *callerContexts) add(ctx context.Context) {
+	done := ctx.Done()
+	switch {
+	case len(c.ctxs) == 0:
+	case c.seen == nil:
+		if c.ctxs[0].Done() == done {
+			return
+		}
+		c.seen = map[<-chan struct{}]struct{}{c.ctxs[0].Done(): {}, done: {}}
+	default:
+		if _, ok := c.seen[done]; ok {
+			return
+		}
+		c.seen[done] = struct{}{}
+	}
+	c.ctxs = append(c.ctxs, ctx)
+}
+
+// mergeContexts returns a context that stays alive while any of ctxs is alive. The returned
+// function must be called once the context is no longer needed to release its resources. It
+// cancels the context, so work started with it doesn't outlive the fetch.
+func mergeContexts(ctxs []context.Context) (context.Context, func()) {
+	if len(ctxs) == 1 {
+		return context.WithCancel(ctxs[0])
+	}
+	m := &mergedContext{Context: ctxs[0], done: make(chan struct{})}
+	release := func() { m.cancel(context.Canceled) }
+
+	m.hasDeadline = true
+	for _, ctx := range ctxs {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			m.hasDeadline = false
+			break
+		}
+		if deadline.After(m.deadline) {
+			m.deadline = deadline
+		}
+	}
+	if !m.hasDeadline {
+		m.deadline = time.Time{}
+	}
+
+	for _, ctx := range ctxs {
+		if ctx.Done() == nil {
+			// this one can never be cancelled, so the merged context is only done once it's released
+			return m, release
+		}
+	}
+
+	go func() {
+		// all of the contexts have to be done, so the order we wait for them in doesn't matter
+		for _, ctx := range ctxs {
+			select {
+			case <-ctx.Done():
+			case <-m.done:
+				return
+			}
+		}
+		err := context.DeadlineExceeded
+		for _, ctx := range ctxs {
+			if ctx.Err() != context.DeadlineExceeded {
+				err = context.Canceled
+				break
+			}
+		}
+		m.cancel(err)
+	}()
+	return m, release
+}
+
+// cancel makes the context done with err, unless it's already done
+func (m *mergedContext) cancel(err error) {
+	m.once.Do(func() {
+		m.err = err
+		close(m.done)
+	})
+}
+
+func (m *mergedContext) Deadline() (time.Time, bool) {
+	return m.deadline, m.hasDeadline
+}
+
+func (m *mergedContext) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *mergedContext) Err() error {
+	select {
+	case <-m.done:
+		return m.err
+	default:
+		return nil
+	}
+}
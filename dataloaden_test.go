@@ -79,10 +79,10 @@ func TestUserLoader(t *testing.T) {
 			if err == nil {
 				t.Fatal("error expected")
 			}
-			if err.(dataloadgen.ErrorSlice)[1] == nil {
+			if err.(dataloadgen.KeyedErrors[string])["E2"] == nil {
 				t.Fatal("error expected")
 			}
-			if err.(dataloadgen.ErrorSlice)[2] == nil {
+			if err.(dataloadgen.KeyedErrors[string])["E3"] == nil {
 				t.Fatal("error expected")
 			}
 		})
@@ -182,7 +182,7 @@ func TestUserLoader(t *testing.T) {
 			if u[1].ID != "U4" {
 				t.Fatal("not equal")
 			}
-			if err.(dataloadgen.ErrorSlice)[2] == nil {
+			if err.(dataloadgen.KeyedErrors[string])["E1"] == nil {
 				t.Fatal("error expected")
 			}
 			if u[3].ID != "U9" {
@@ -293,10 +293,10 @@ func TestUserLoader(t *testing.T) {
 			t.Fatal("wrong length", fetches)
 		}
 
-		if err2.(dataloadgen.ErrorSlice)[0] != nil {
-			t.Fatal(err2.(dataloadgen.ErrorSlice)[0])
+		if err2.(dataloadgen.KeyedErrors[string])["U6"] != nil {
+			t.Fatal(err2.(dataloadgen.KeyedErrors[string])["U6"])
 		}
-		if err2.(dataloadgen.ErrorSlice)[1] == nil {
+		if err2.(dataloadgen.KeyedErrors[string])["E6"] == nil {
 			t.Fatal("error expected")
 		}
 		if "user U6" != users2[0].Name {
@@ -332,19 +332,19 @@ func TestUserLoader(t *testing.T) {
 				t.Fatal("not empty", user)
 			}
 		}
-		if len(errs.(dataloadgen.ErrorSlice)) != 2 {
+		if len(errs.(dataloadgen.KeyedErrors[string])) != 2 {
 			t.Fatal("wrong length", errs)
 		}
-		if errs.(dataloadgen.ErrorSlice)[0] == nil {
+		if errs.(dataloadgen.KeyedErrors[string])["F1"] == nil {
 			t.Fatal("error expected")
 		}
-		if "failed all fetches" != errs.(dataloadgen.ErrorSlice)[0].Error() {
+		if "failed all fetches" != errs.(dataloadgen.KeyedErrors[string])["F1"].Error() {
 			t.Fatal("not equal")
 		}
-		if errs.(dataloadgen.ErrorSlice)[1] == nil {
+		if errs.(dataloadgen.KeyedErrors[string])["U1"] == nil {
 			t.Fatal("error expected")
 		}
-		if "failed all fetches" != errs.(dataloadgen.ErrorSlice)[1].Error() {
+		if "failed all fetches" != errs.(dataloadgen.KeyedErrors[string])["U1"].Error() {
 			t.Fatal("not equal")
 		}
 	})
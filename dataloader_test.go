@@ -117,34 +117,20 @@ func TestLoader(t *testing.T) {
 		t.Parallel()
 		errorLoader, _ := ErrorLoader(0)
 		_, err := errorLoader.LoadAll(ctx, []string{"1", "2", "3"})
-		if len(err.(dataloadgen.ErrorSlice)) != 3 {
+		if len(err.(dataloadgen.KeyedErrors[string])) != 3 {
 			t.Error("LoadAll didn't return right number of errors")
 		}
 	})
 
-	t.Run("test LoadAll returns len(errors) == len(keys)", func(t *testing.T) {
+	t.Run("test LoadAll returns errors only for failed keys", func(t *testing.T) {
 		t.Parallel()
 		loader, _ := OneErrorLoader(3)
 		_, errs := loader.LoadAll(ctx, []string{"1", "2", "3"})
-		if len(errs.(dataloadgen.ErrorSlice)) != 3 {
-			t.Errorf("LoadAll didn't return right number of errors (should match size of input)")
-		}
-
-		var errCount int = 0
-		var nilCount int = 0
-		for _, err := range errs.(dataloadgen.ErrorSlice) {
-			if err == nil {
-				nilCount++
-			} else {
-				errCount++
-			}
-		}
-		if errCount != 1 {
+		if len(errs.(dataloadgen.KeyedErrors[string])) != 1 {
 			t.Error("Expected an error on only one of the items loaded")
 		}
-
-		if nilCount != 2 {
-			t.Error("Expected second and third errors to be nil")
+		if errs.(dataloadgen.KeyedErrors[string])["1"] == nil {
+			t.Error("Expected the first key to fail")
 		}
 	})
 
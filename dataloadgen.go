@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -36,8 +40,169 @@ func WithTracer(tracer trace.Tracer) Option {
 	}
 }
 
-// NewLoader creates a new GenericLoader given a fetch, wait, and maxBatch
-func NewLoader[KeyT comparable, ValueT any](fetch func(ctx context.Context, keys []KeyT) ([]ValueT, []error), options ...Option) *Loader[KeyT, ValueT] {
+// FetchContext selects the context that is passed to the fetch function. Either way, the context
+// is cancelled once the fetch function returns.
+type FetchContext int
+
+const (
+	// MergedContext passes a context that carries the values of the first caller's context and is
+	// cancelled only once the contexts of all callers waiting on the batch are done. This is the default.
+	MergedContext FetchContext = iota
+	// FirstContext passes a context derived from the context of the first caller in the batch, so the
+	// fetch is cancelled as soon as that caller's context is done.
+	FirstContext
+)
+
+// WithBatchPartition makes the loader collect separate batches for callers whose contexts map to
+// different partition values, for example different tenants. Each batch is fetched with a context
+// of its own partition. Partition values must be comparable.
+// Each partition caches the values it fetched separately, so results are only shared through the
+// cache between callers of the same partition. Values passed to Prime and Set are shared by all
+// partitions, and Clear clears a key in all of them. SetInPartition and WriteThrough only set a value
+// for the partition of their context.
+func WithBatchPartition(partition func(ctx context.Context) any) Option {
+	return func(l *loaderConfig) {
+		l.partition = partition
+	}
+}
+
+// WithShardFunc makes the loader collect a separate batch for each shard returned by shard, so that
+// each fetch only contains keys of a single shard. The fetch function can get the shard from its
+// context with ShardFromContext. KeyT must match the key type of the loader.
+func WithShardFunc[KeyT any](shard func(KeyT) string) Option {
+	return func(l *loaderConfig) {
+		l.shardFunc = shard
+	}
+}
+
+type shardKey struct{}
+
+// ShardFromContext returns the shard of the batch being fetched when the loader uses WithShardFunc
+func ShardFromContext(ctx context.Context) (string, bool) {
+	shard, ok := ctx.Value(shardKey{}).(string)
+	return shard, ok
+}
+
+// WithPanicOnContractViolation makes callers panic with a *FetchContractError instead of returning it
+// when the fetch function returns the wrong number of values or errors. It's meant for tests.
+func WithPanicOnContractViolation() Option {
+	return func(l *loaderConfig) {
+		l.panicOnContractViolation = true
+	}
+}
+
+// WithPanicHandler sets a function that is called when a caller receives a *PanicError because the
+// fetch function panicked. It runs on the caller's goroutine with the caller's context, once for
+// each caller of the failed batch, so it can re-panic to crash the caller or report to a crash tracker.
+// Keys that failed with a panic aren't cached, so later calls fetch them again.
+func WithPanicHandler(handler func(ctx context.Context, err *PanicError)) Option {
+	return func(l *loaderConfig) {
+		l.panicHandler = handler
+	}
+}
+
+// WithStrictMappedFetch makes loaders created by NewMappedLoader check the keys returned by the mapped
+// fetch function. Keys that weren't requested are passed to onUnexpected, if it's not nil, and keys
+// that got neither a value nor an error fail with a *MissingKeyError instead of ErrNotFound.
+// To report missing data in strict mode, return ErrNotFound for the key in a MappedFetchError.
+// KeyT must match the key type of the loader.
+func WithStrictMappedFetch[KeyT comparable](onUnexpected func(ctx context.Context, keys []KeyT)) Option {
+	return func(l *loaderConfig) {
+		l.strictMapped = true
+		if onUnexpected != nil {
+			l.onUnexpectedKeys = onUnexpected
+		}
+	}
+}
+
+// WithMissingZero makes loaders created by NewMappedLoader return the zero value and no error for
+// keys that the mapped fetch function returned neither a value nor an error for, instead of ErrNotFound.
+// The WithMissing options replace each other and have no effect with WithStrictMappedFetch.
+func WithMissingZero() Option {
+	return func(l *loaderConfig) {
+		l.missing = missingZero{}
+	}
+}
+
+// WithMissingDefault makes loaders created by NewMappedLoader return the value created by newValue and
+// no error for keys that the mapped fetch function returned neither a value nor an error for, instead
+// of ErrNotFound. KeyT and ValueT must match the loader.
+func WithMissingDefault[KeyT comparable, ValueT any](newValue func(key KeyT) ValueT) Option {
+	return func(l *loaderConfig) {
+		l.missing = missingDefault[KeyT, ValueT](newValue)
+	}
+}
+
+// WithMissingError makes loaders created by NewMappedLoader return the error created by newErr for keys
+// that the mapped fetch function returned neither a value nor an error for, instead of ErrNotFound.
+// KeyT must match the key type of the loader.
+func WithMissingError[KeyT comparable](newErr func(key KeyT) error) Option {
+	return func(l *loaderConfig) {
+		l.missing = missingError[KeyT](newErr)
+	}
+}
+
+// WithOnResult adds a function that is called with every key and value that a batch loaded without
+// an error, before the callers waiting for the batch get their results. It can be used to prime other
+// loaders, see LinkLoaders. KeyT and ValueT must match the loader.
+func WithOnResult[KeyT comparable, ValueT any](onResult func(key KeyT, value ValueT)) Option {
+	return func(l *loaderConfig) {
+		l.onResult = append(l.onResult, onResult)
+	}
+}
+
+// WithKeyNormalizer makes the loader normalize every key passed to it, for example by lowercasing
+// emails, so that equivalent keys share a cache entry and a batch slot. The fetch function receives
+// normalized keys, and the keys returned by mapped and grouped fetch functions are normalized before
+// they're matched up with the requested keys. KeyT must match the key type of the loader.
+func WithKeyNormalizer[KeyT comparable](normalize func(KeyT) KeyT) Option {
+	return func(l *loaderConfig) {
+		l.normalizer = normalize
+	}
+}
+
+// WithKeyOrder sorts the keys of each batch with less before passing them to the fetch function,
+// which makes queries and tests deterministic. By default keys are passed in the order they were
+// first loaded in. KeyT must match the key type of the loader.
+func WithKeyOrder[KeyT comparable](less func(a, b KeyT) bool) Option {
+	return func(l *loaderConfig) {
+		l.keyLess = less
+	}
+}
+
+// WithNegativeCacheTTL limits how long results that failed with ErrNotFound are kept in the cache.
+// Other results stay cached for the lifetime of the loader, like ErrNotFound results do by default.
+// A ttl of 0 means that ErrNotFound results are only shared by callers waiting for the same fetch.
+func WithNegativeCacheTTL(ttl time.Duration) Option {
+	return func(l *loaderConfig) {
+		l.negativeCache = true
+		l.negativeTTL = ttl
+	}
+}
+
+// FetchFunc is the signature of the fetch functions passed to NewLoader, and of the fetch functions
+// that the loaders created by NewMappedLoader and NewGroupedLoader wrap their fetch functions in.
+type FetchFunc[KeyT comparable, ValueT any] func(ctx context.Context, keys []KeyT) ([]ValueT, []error)
+
+// WithFetchMiddleware wraps the fetch function of the loader, for example to add logging, auth checks
+// or retries. Middleware runs in the order it's added, so the first one added is the outermost one.
+// Panics in middleware are recovered like panics in the fetch function. KeyT and ValueT must match
+// the loader, which is []ValueT for grouped loaders.
+func WithFetchMiddleware[KeyT comparable, ValueT any](middleware func(next FetchFunc[KeyT, ValueT]) FetchFunc[KeyT, ValueT]) Option {
+	return func(l *loaderConfig) {
+		l.fetchMiddleware = append(l.fetchMiddleware, middleware)
+	}
+}
+
+// WithFetchContext sets which context is passed to the fetch function.
+// Default is MergedContext.
+func WithFetchContext(c FetchContext) Option {
+	return func(l *loaderConfig) {
+		l.fetchContext = c
+	}
+}
+
+func newLoaderConfig(options []Option) *loaderConfig {
 	config := &loaderConfig{
 		wait:     16 * time.Millisecond,
 		maxBatch: 0, // unlimited
@@ -45,25 +210,203 @@ func NewLoader[KeyT comparable, ValueT any](fetch func(ctx context.Context, keys
 	for _, o := range options {
 		o(config)
 	}
+	return config
+}
+
+// NewLoader creates a new GenericLoader given a fetch, wait, and maxBatch
+func NewLoader[KeyT comparable, ValueT any](fetch func(ctx context.Context, keys []KeyT) ([]ValueT, []error), options ...Option) *Loader[KeyT, ValueT] {
+	config := newLoaderConfig(options)
 	l := &Loader[KeyT, ValueT]{
-		fetch:        fetch,
 		loaderConfig: config,
-		thunkCache:   map[KeyT]func() (ValueT, error){},
+		cache:        map[KeyT]*loaderEntry[KeyT, ValueT]{},
+		batches:      map[batchKey]*loaderBatch[KeyT, ValueT]{},
+	}
+	if config.shardFunc != nil {
+		shard, ok := config.shardFunc.(func(KeyT) string)
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithShardFunc was given a %T for a loader with %T keys", config.shardFunc, *new(KeyT)))
+		}
+		l.shard = shard
+	}
+	if config.normalizer != nil {
+		normalize, ok := config.normalizer.(func(KeyT) KeyT)
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithKeyNormalizer was given a %T for a loader with %T keys", config.normalizer, *new(KeyT)))
+		}
+		l.normalize = normalize
+	}
+	if config.keyLess != nil {
+		less, ok := config.keyLess.(func(a, b KeyT) bool)
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithKeyOrder was given a %T for a loader with %T keys", config.keyLess, *new(KeyT)))
+		}
+		l.keyLess = less
+	}
+	for _, onResult := range config.onResult {
+		typed, ok := onResult.(func(KeyT, ValueT))
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithOnResult was given a %T for a loader with %T keys and %T values", onResult, *new(KeyT), *new(ValueT)))
+		}
+		l.onResult = append(l.onResult, func(_ any, key KeyT, value ValueT) { typed(key, value) })
+	}
+	for _, middleware := range config.fetchMiddleware {
+		typed, ok := middleware.(func(FetchFunc[KeyT, ValueT]) FetchFunc[KeyT, ValueT])
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithFetchMiddleware was given a %T for a loader with %T keys and %T values", middleware, *new(KeyT), *new(ValueT)))
+		}
+		l.middleware = append(l.middleware, typed)
+	}
+	for _, observer := range config.observers {
+		typed, ok := observer.(Observer[KeyT])
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithObserver was given a %T for a loader with %T keys", observer, *new(KeyT)))
+		}
+		l.observers = append(l.observers, typed)
+	}
+	if config.meterProvider != nil {
+		l.metrics = newLoaderMetrics(config.meterProvider, config.name)
+	}
+	if fetch != nil {
+		l.fetch = l.wrapFetch(fetch)
 	}
 	return l
 }
 
+// wrapFetch wraps fetch in the middleware of the loader
+func (l *Loader[KeyT, ValueT]) wrapFetch(fetch FetchFunc[KeyT, ValueT]) FetchFunc[KeyT, ValueT] {
+	for i := len(l.middleware) - 1; i >= 0; i-- {
+		fetch = l.middleware[i](fetch)
+	}
+	return fetch
+}
+
 // NewMappedLoader creates a new GenericLoader given a mappedFetch, wait and maxBatch
 func NewMappedLoader[KeyT comparable, ValueT any](mappedFetch func(ctx context.Context, keys []KeyT) (map[KeyT]ValueT, error), options ...Option) *Loader[KeyT, ValueT] {
-	return NewLoader(convertMappedFetch(mappedFetch), options...)
+	l := NewLoader[KeyT, ValueT](nil, options...)
+	mc := newMappedConfig[KeyT, ValueT](l.loaderConfig)
+	mc.normalize = l.normalize
+	l.fetch = l.wrapFetch(convertMappedFetch(mappedFetch, mc))
+	return l
+}
+
+// mappedConfig holds the options of NewMappedLoader that depend on the key and value types
+type mappedConfig[KeyT comparable, ValueT any] struct {
+	strict       bool
+	onUnexpected func(ctx context.Context, keys []KeyT)
+	normalize    func(KeyT) KeyT
+
+	// at most one of these is set, if none are the loader returns ErrNotFound for missing keys
+	missingZero    bool
+	missingDefault func(KeyT) ValueT
+	missingError   func(KeyT) error
+}
+
+// missingPolicy is set by the WithMissing options
+type missingPolicy interface {
+	option() string
+}
+
+type missingZero struct{}
+
+type missingDefault[KeyT comparable, ValueT any] func(KeyT) ValueT
+
+type missingError[KeyT comparable] func(KeyT) error
+
+func (missingZero) option() string                  { return "WithMissingZero" }
+func (missingDefault[KeyT, ValueT]) option() string { return "WithMissingDefault" }
+func (missingError[KeyT]) option() string           { return "WithMissingError" }
+
+func newMappedConfig[KeyT comparable, ValueT any](config *loaderConfig) *mappedConfig[KeyT, ValueT] {
+	mc := &mappedConfig[KeyT, ValueT]{strict: config.strictMapped}
+	switch policy := config.missing.(type) {
+	case nil:
+	case missingZero:
+		mc.missingZero = true
+	case missingDefault[KeyT, ValueT]:
+		mc.missingDefault = policy
+	case missingError[KeyT]:
+		mc.missingError = policy
+	default:
+		panic(fmt.Sprintf("dataloadgen: %s was given a %T for a loader with %T keys and %T values", policy.option(), policy, *new(KeyT), *new(ValueT)))
+	}
+	if config.onUnexpectedKeys != nil {
+		onUnexpected, ok := config.onUnexpectedKeys.(func(context.Context, []KeyT))
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithStrictMappedFetch was given a %T for a loader with %T keys", config.onUnexpectedKeys, *new(KeyT)))
+		}
+		mc.onUnexpected = onUnexpected
+	}
+	return mc
+}
+
+// unexpectedKeys returns the keys that have a value or an error but weren't requested
+func (mc *mappedConfig[KeyT, ValueT]) unexpectedKeys(keys []KeyT, mappedResults map[KeyT]ValueT, mfe MappedFetchError[KeyT]) []KeyT {
+	var unexpected []KeyT
+	seen := make(map[KeyT]struct{}, len(keys))
+	for _, key := range keys {
+		seen[key] = struct{}{}
+	}
+	for key := range mappedResults {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			unexpected = append(unexpected, key)
+		}
+	}
+	for key := range mfe {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			unexpected = append(unexpected, key)
+		}
+	}
+	return unexpected
+}
+
+// missing returns the result for a key that got neither a value nor an error
+func (mc *mappedConfig[KeyT, ValueT]) missing(key KeyT, unexpected []KeyT) (ValueT, error) {
+	var zero ValueT
+	switch {
+	case mc.strict:
+		return zero, &MissingKeyError[KeyT]{Key: key, Unexpected: unexpected}
+	case mc.missingZero:
+		return zero, nil
+	case mc.missingDefault != nil:
+		return mc.missingDefault(key), nil
+	case mc.missingError != nil:
+		return zero, mc.missingError(key)
+	}
+	return zero, ErrNotFound
+}
+
+// normalizeKeys returns a copy of m with normalized keys
+func normalizeKeys[M ~map[KeyT]V, KeyT comparable, V any](m M, normalize func(KeyT) KeyT) M {
+	if m == nil {
+		return nil
+	}
+	normalized := make(M, len(m))
+	for key, value := range m {
+		normalized[normalize(key)] = value
+	}
+	return normalized
 }
 
 // convertMappedFetch accepts a fetcher method that returns maps, and converts it to a fetcher that returns lists.
-func convertMappedFetch[KeyT comparable, ValueT any](mappedFetch func(ctx context.Context, keys []KeyT) (map[KeyT]ValueT, error)) func(ctx context.Context, keys []KeyT) ([]ValueT, []error) {
+func convertMappedFetch[KeyT comparable, ValueT any](mappedFetch func(ctx context.Context, keys []KeyT) (map[KeyT]ValueT, error), mc *mappedConfig[KeyT, ValueT]) func(ctx context.Context, keys []KeyT) ([]ValueT, []error) {
 	return func(ctx context.Context, keys []KeyT) ([]ValueT, []error) {
 		mappedResults, err := mappedFetch(ctx, keys)
 		var mfe MappedFetchError[KeyT]
 		isMappedFetchError := errors.As(err, &mfe)
+		if mc.normalize != nil {
+			mappedResults = normalizeKeys(mappedResults, mc.normalize)
+			mfe = normalizeKeys(mfe, mc.normalize)
+		}
+
+		var unexpected []KeyT
+		if mc.strict {
+			unexpected = mc.unexpectedKeys(keys, mappedResults, mfe)
+			if len(unexpected) > 0 && mc.onUnexpected != nil {
+				mc.onUnexpected(ctx, unexpected)
+			}
+		}
 
 		var values = make([]ValueT, len(keys))
 		var errs = make([]error, len(keys))
@@ -80,15 +423,15 @@ func convertMappedFetch[KeyT comparable, ValueT any](mappedFetch func(ctx contex
 				if keyErr, hasError := mfe[key]; hasError {
 					errs[i] = keyErr
 				} else if !found {
-					// Key not found and no specific error -> ErrNotFound
-					errs[i] = ErrNotFound
+					// Key not found and no specific error -> ErrNotFound, or whatever the missing key policy says
+					values[i], errs[i] = mc.missing(key, unexpected)
 				}
 			} else if err != nil {
 				// Single error applies to all keys
 				errs[i] = err
 			} else if !found {
-				// No error but key not found -> ErrNotFound
-				errs[i] = ErrNotFound
+				// No error but key not found -> ErrNotFound, or whatever the missing key policy says
+				values[i], errs[i] = mc.missing(key, unexpected)
 			}
 		}
 		return values, errs
@@ -97,6 +440,23 @@ func convertMappedFetch[KeyT comparable, ValueT any](mappedFetch func(ctx contex
 
 type MappedFetchError[KeyT comparable] map[KeyT]error
 
+// MissingKeyError is returned instead of ErrNotFound by loaders using WithStrictMappedFetch for keys
+// that the mapped fetch function returned neither a value nor an error for.
+type MissingKeyError[KeyT comparable] struct {
+	Key KeyT
+	// Unexpected lists the keys of the same batch that were returned without being requested.
+	// They often differ from Key only in normalisation, for example in case.
+	Unexpected []KeyT
+}
+
+// Error implements the error interface
+func (e *MissingKeyError[KeyT]) Error() string {
+	if len(e.Unexpected) == 0 {
+		return fmt.Sprint("dataloadgen: mapped fetch returned no value or error for key ", e.Key)
+	}
+	return fmt.Sprint("dataloadgen: mapped fetch returned no value or error for key ", e.Key, ", unexpected keys returned: ", e.Unexpected)
+}
+
 func (e MappedFetchError[KeyT]) Error() string {
 	var errSlice = make([]string, len(e))
 	i := 0
@@ -115,106 +475,457 @@ type loaderConfig struct {
 	maxBatch int
 
 	tracer trace.Tracer
+
+	fetchContext FetchContext
+
+	partition func(ctx context.Context) any
+
+	// a func(KeyT) string, checked by NewLoader
+	shardFunc any
+
+	panicOnContractViolation bool
+
+	panicHandler func(ctx context.Context, err *PanicError)
+
+	strictMapped bool
+	// a func(context.Context, []KeyT), checked by NewMappedLoader
+	onUnexpectedKeys any
+
+	// how NewMappedLoader handles missing keys, nil for ErrNotFound
+	missing missingPolicy
+
+	// options of NewGroupedLoader, groupLess is a func(a, b ValueT) bool
+	groupLimit int
+	groupLess  any
+
+	// func(KeyT, ValueT) hooks, checked by NewLoader
+	onResult []any
+
+	// a func(KeyT) KeyT, checked by NewLoader
+	normalizer any
+
+	// a func(a, b KeyT) bool, checked by NewLoader
+	keyLess any
+
+	// a func(prev, next InputT) InputT, checked by NewWriter
+	coalesce any
+
+	// func(FetchFunc[KeyT, ValueT]) FetchFunc[KeyT, ValueT] wrappers, checked by NewLoader
+	fetchMiddleware []any
+
+	// Observer[KeyT] values, checked by NewLoader
+	observers []any
+
+	meterProvider metric.MeterProvider
+	name          string
+
+	// how long ErrNotFound results are cached for when negativeCache is set
+	negativeCache bool
+	negativeTTL   time.Duration
 }
 
 // Loader batches and caches requests
 type Loader[KeyT comparable, ValueT any] struct {
-	// this method provides the data for the loader
-	fetch func(ctx context.Context, keys []KeyT) ([]ValueT, []error)
+	// this method provides the data for the loader, wrapped in the fetch middleware
+	fetch FetchFunc[KeyT, ValueT]
+
+	// middleware wraps fetch, the first one is the outermost
+	middleware []func(FetchFunc[KeyT, ValueT]) FetchFunc[KeyT, ValueT]
 
 	*loaderConfig
 
+	// shard assigns keys to batches, nil if the loader isn't sharded
+	shard func(KeyT) string
+
+	// called with the partition of the batch for every successfully loaded key, protected by mu
+	onResult []func(partition any, key KeyT, value ValueT)
+
+	// normalize maps equivalent keys to the same key, nil if keys are used as is
+	normalize func(KeyT) KeyT
+
+	// keyLess orders the keys passed to fetch, nil for the order they were loaded in
+	keyLess func(a, b KeyT) bool
+
+	observers []Observer[KeyT]
+
+	// metrics is nil if the loader has no meter provider
+	metrics *loaderMetrics
+
+	// called with the mutex held when a new entry is added to a batch and when an entry leaves its
+	// batch without being fetched, nil unless the loader belongs to a HashedLoader
+	onEnqueue, onDrop func(KeyT)
+
+	// protected by mu
+	stats Stats
+
 	// INTERNAL
 
-	// lazily created thunkCache
-	thunkCache map[KeyT]func() (ValueT, error)
+	// lazily created cache of entries by key. If the loader is partitioned, it only holds the entries
+	// shared by all partitions, which are the primed and Set ones.
+	cache map[KeyT]*loaderEntry[KeyT, ValueT]
 
-	// the current batch. keys will continue to be collected until timeout is hit,
+	// the fetched entries of each partition by key, only used if the loader is partitioned
+	partitions map[any]map[KeyT]*loaderEntry[KeyT, ValueT]
+
+	// the current batch of each partition and shard. keys will continue to be collected until timeout is hit,
 	// then everything will be sent to the fetch method and out to the listeners
-	batch *loaderBatch[KeyT, ValueT]
+	batches map[batchKey]*loaderBatch[KeyT, ValueT]
 
 	// mutex to prevent races
 	mu sync.Mutex
 }
 
+// batchKey identifies which of the current batches a key goes into
+type batchKey struct {
+	partition any
+	shard     string
+}
+
 type loaderBatch[KeyT comparable, ValueT any] struct {
-	keys          []KeyT
-	results       []ValueT
-	errors        []error
+	key           batchKey
+	entries       []*loaderEntry[KeyT, ValueT]
 	fetchExecuted bool
-	done          chan struct{}
 	firstContext  context.Context
+	reason        DispatchReason
+	callers       callerContexts
 	contexts      []context.Context
 	spans         []trace.Span
 }
 
-// Load a ValueT by key, batching and caching will be applied automatically
+// loaderEntry is the cached result for a single key. Until its batch is done, value and err are not set.
+type loaderEntry[KeyT comparable, ValueT any] struct {
+	key   KeyT
+	value ValueT
+	err   error
+
+	// closed once value and err are set, with the mutex held for pending entries
+	done chan struct{}
+
+	// the batch that will set value and err, nil for primed entries
+	batch *loaderBatch[KeyT, ValueT]
+	// the contexts of the callers waiting for this entry while its batch is pending
+	waiters callerContexts
+	// set when every caller gave up before the batch was dispatched
+	dropped bool
+	// set when Set gave the entry a value before its batch was done
+	set bool
+	// set when the entry failed with ErrNotFound
+	notFound bool
+	// when the entry stops being served from the cache, zero if it never does
+	expires time.Time
+	// when the entry was added to its batch, only set if the loader records metrics
+	enqueued time.Time
+}
+
+// closedChan is shared by all entries that are done from the start
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Load a ValueT by key, batching and caching will be applied automatically.
+// If ctx is done before the value is available, ctx.Err() is returned.
 func (l *Loader[KeyT, ValueT]) Load(ctx context.Context, key KeyT) (ValueT, error) {
-	return l.LoadThunk(ctx, key)()
+	return l.await(ctx, l.loadEntry(ctx, key))
 }
 
 // LoadThunk returns a function that when called will block waiting for a ValueT.
 // This method should be used if you want one goroutine to make requests to many
 // different data loaders without blocking until the thunk is called.
+// If ctx is done before the value is available, the thunk returns ctx.Err().
 func (l *Loader[KeyT, ValueT]) LoadThunk(ctx context.Context, key KeyT) func() (ValueT, error) {
+	entry := l.loadEntry(ctx, key)
+	return func() (ValueT, error) {
+		return l.await(ctx, entry)
+	}
+}
+
+// loadEntry returns the cached entry for key, adding the key to the current batch if it's not cached
+func (l *Loader[KeyT, ValueT]) loadEntry(ctx context.Context, key KeyT) *loaderEntry[KeyT, ValueT] {
+	if l.normalize != nil {
+		key = l.normalize(key)
+	}
+	var bk batchKey
+	if l.partition != nil {
+		bk.partition = l.partition(ctx)
+	}
+	if l.shard != nil {
+		bk.shard = l.shard(key)
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	if it, ok := l.thunkCache[key]; ok {
-		return it
+	if entry, ok := l.cached(bk.partition, key); ok {
+		if entry.batch != nil && !entry.batch.fetchExecuted {
+			entry.addWaiter(ctx)
+			l.addCaller(entry.batch, ctx)
+		}
+		if entry.notFound {
+			l.stats.NegativeHits++
+		} else {
+			l.stats.Hits++
+		}
+		for _, o := range l.observers {
+			o.CacheHit(ctx, key)
+		}
+		if l.metrics != nil {
+			l.metrics.cacheHits.Add(ctx, 1, l.metrics.attrs)
+		}
+		return entry
+	}
+	l.stats.Misses++
+	if l.metrics != nil {
+		l.metrics.cacheMisses.Add(ctx, 1, l.metrics.attrs)
 	}
 
-	l.startBatch(ctx)
+	batch := l.startBatch(ctx, bk)
 
 	if l.tracer != nil {
 		_, loadSpan := l.tracer.Start(ctx, "dataloadgen.load")
 		defer loadSpan.End()
-		l.batch.contexts = append(l.batch.contexts, ctx)
+		batch.contexts = append(batch.contexts, ctx)
 		_, waitSpan := l.tracer.Start(ctx, "dataloadgen.wait")
-		l.batch.spans = append(l.batch.spans, waitSpan)
+		batch.spans = append(batch.spans, waitSpan)
 	}
 
-	batch := l.batch
-	pos := l.addKeyToBatch(batch, key)
+	l.addCaller(batch, ctx)
+	entry := &loaderEntry[KeyT, ValueT]{
+		key:   key,
+		done:  make(chan struct{}),
+		batch: batch,
+	}
+	entry.waiters.add(ctx)
+	if l.metrics != nil {
+		entry.enqueued = time.Now()
+	}
+	l.entries(bk.partition)[key] = entry
+	for _, o := range l.observers {
+		o.KeyEnqueued(ctx, key)
+	}
+	if l.onEnqueue != nil {
+		l.onEnqueue(key)
+	}
+	l.addEntryToBatch(batch, entry)
+	return entry
+}
 
-	thunk := func() (ValueT, error) {
-		<-batch.done
+// addCaller records ctx as one of the contexts the batch will be fetched on behalf of
+func (l *Loader[KeyT, ValueT]) addCaller(b *loaderBatch[KeyT, ValueT], ctx context.Context) {
+	if l.fetchContext == MergedContext {
+		b.callers.add(ctx)
+	}
+}
 
-		var data ValueT
+// await blocks until the entry is done or ctx is done
+func (l *Loader[KeyT, ValueT]) await(ctx context.Context, entry *loaderEntry[KeyT, ValueT]) (value ValueT, err error) {
+	if len(l.observers) != 0 {
+		defer func() {
+			for _, o := range l.observers {
+				o.KeyDelivered(ctx, entry.key, err)
+			}
+		}()
+	}
+	// dropped entries are never done, but nobody whose context isn't done waits for them
+	select {
+	case <-entry.done:
+		return l.result(ctx, entry)
+	default:
+	}
+	select {
+	case <-entry.done:
+		return l.result(ctx, entry)
+	case <-ctx.Done():
+		l.giveUp(entry)
+		var zero ValueT
+		return zero, ctx.Err()
+	}
+}
 
-		// Return early if there's a single error and it's not nil
-		if len(batch.errors) == 1 && batch.errors[0] != nil {
-			return data, batch.errors[0]
-		}
+// result returns the value and error of a done entry
+func (l *Loader[KeyT, ValueT]) result(ctx context.Context, entry *loaderEntry[KeyT, ValueT]) (ValueT, error) {
+	l.handleErr(ctx, entry.err)
+	return entry.value, entry.err
+}
 
-		// If the batch function returned the wrong number of responses, return an error to all callers
-		if len(batch.results) != len(batch.keys) {
-			return data, fmt.Errorf("bug in fetch function: %d values returned for %d keys", len(batch.results), len(batch.keys))
+// handleErr applies the options for panics and contract violations to an error a caller is about to receive
+func (c *loaderConfig) handleErr(ctx context.Context, err error) {
+	if c.panicOnContractViolation {
+		if contractErr, ok := err.(*FetchContractError); ok {
+			panic(contractErr)
+		}
+	}
+	if c.panicHandler != nil {
+		if panicErr, ok := err.(*PanicError); ok {
+			c.panicHandler(ctx, panicErr)
 		}
+	}
+}
 
-		if pos < len(batch.results) {
-			data = batch.results[pos]
+// giveUp is called when a caller's context is done before the entry. If nobody else is waiting and
+// the batch hasn't been dispatched yet, the key is dropped from the batch and from the cache.
+func (l *Loader[KeyT, ValueT]) giveUp(entry *loaderEntry[KeyT, ValueT]) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry.batch == nil || entry.batch.fetchExecuted || entry.dropped || entry.live() {
+		return
+	}
+	l.drop(entry)
+}
+
+// drop removes a pending entry from its batch and from the cache. It must be called with the mutex held.
+func (l *Loader[KeyT, ValueT]) drop(entry *loaderEntry[KeyT, ValueT]) {
+	entry.dropped = true
+	if l.onDrop != nil {
+		l.onDrop(entry.key)
+	}
+	l.uncache(entry)
+}
+
+// uncache removes an entry from the cache, unless it was already replaced. It must be called
+// with the mutex held.
+func (l *Loader[KeyT, ValueT]) uncache(entry *loaderEntry[KeyT, ValueT]) {
+	if l.partition == nil || entry.batch == nil {
+		if l.cache[entry.key] == entry {
+			delete(l.cache, entry.key)
+		}
+		return
+	}
+	partition := entry.batch.key.partition
+	if entries := l.partitions[partition]; entries[entry.key] == entry {
+		delete(entries, entry.key)
+		if len(entries) == 0 {
+			delete(l.partitions, partition)
 		}
+	}
+}
 
-		var err error
-		if len(batch.errors) != 0 {
-			if pos < len(batch.errors) {
-				err = batch.errors[pos]
-			} else {
-				err = fmt.Errorf("bug in fetch function: %d errors returned for %d keys; last error: %w", len(batch.errors), len(batch.keys), batch.errors[len(batch.errors)-1])
+// cached returns the entry that callers of partition get for key: their partition's own entry if
+// it has one, otherwise the shared one. It must be called with the mutex held.
+func (l *Loader[KeyT, ValueT]) cached(partition any, key KeyT) (*loaderEntry[KeyT, ValueT], bool) {
+	if l.partition != nil {
+		if entry, ok := l.partitions[partition][key]; ok {
+			if !entry.expired() {
+				return entry, true
 			}
+			l.uncache(entry)
+		}
+	}
+	entry, ok := l.cache[key]
+	if ok && entry.expired() {
+		l.uncache(entry)
+		return nil, false
+	}
+	return entry, ok
+}
+
+// entries returns the map that the fetched entries of partition are cached in. It must be called
+// with the mutex held.
+func (l *Loader[KeyT, ValueT]) entries(partition any) map[KeyT]*loaderEntry[KeyT, ValueT] {
+	if l.partition == nil {
+		return l.cache
+	}
+	entries, ok := l.partitions[partition]
+	if !ok {
+		if l.partitions == nil {
+			l.partitions = map[any]map[KeyT]*loaderEntry[KeyT, ValueT]{}
+		}
+		entries = map[KeyT]*loaderEntry[KeyT, ValueT]{}
+		l.partitions[partition] = entries
+	}
+	return entries
+}
+
+// expired reports whether the entry is too old to be served from the cache. It must be called with the mutex held.
+func (e *loaderEntry[KeyT, ValueT]) expired() bool {
+	return !e.expires.IsZero() && time.Now().After(e.expires)
+}
+
+// addWaiter records that a caller with ctx is waiting for the entry
+func (e *loaderEntry[KeyT, ValueT]) addWaiter(ctx context.Context) {
+	e.waiters.add(ctx)
+}
 
+// live reports whether any caller waiting for the entry still has a context that isn't done
+func (e *loaderEntry[KeyT, ValueT]) live() bool {
+	for _, ctx := range e.waiters.ctxs {
+		if ctx.Err() == nil {
+			return true
 		}
+	}
+	return false
+}
+
+// PanicError is returned to callers when the fetch function panics
+type PanicError struct {
+	// Value is the value the fetch function panicked with
+	Value any
+	// Stack is the stack trace of the goroutine that panicked
+	Stack []byte
+}
+
+// Error implements the error interface
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic during fetch: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it's an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// FetchContractViolation describes how a fetch function broke its contract
+type FetchContractViolation int
+
+const (
+	// WrongValueCount means that fetch returned a different number of values than there were keys
+	WrongValueCount FetchContractViolation = iota + 1
+	// WrongErrorCount means that fetch returned fewer errors than there were keys, other than a single non-nil error
+	WrongErrorCount
+)
 
-		return data, err
+func (v FetchContractViolation) String() string {
+	switch v {
+	case WrongValueCount:
+		return "wrong value count"
+	case WrongErrorCount:
+		return "wrong error count"
 	}
-	l.thunkCache[key] = thunk
-	return thunk
+	return fmt.Sprintf("FetchContractViolation(%d)", int(v))
+}
+
+// FetchContractError is returned to callers when the fetch function returned the wrong number of
+// values or errors for the keys it was given. It always indicates a bug in the fetch function.
+type FetchContractError struct {
+	Violation FetchContractViolation
+	// Keys is the number of keys passed to fetch
+	Keys int
+	// Returned is the number of values or errors fetch returned, depending on Violation
+	Returned int
+	// LastErr is the last error returned by fetch for WrongErrorCount violations
+	LastErr error
+}
+
+// Error implements the error interface
+func (e *FetchContractError) Error() string {
+	if e.Violation == WrongErrorCount {
+		return fmt.Sprintf("bug in fetch function: %d errors returned for %d keys; last error: %v", e.Returned, e.Keys, e.LastErr)
+	}
+	return fmt.Sprintf("bug in fetch function: %d values returned for %d keys", e.Returned, e.Keys)
+}
+
+// Unwrap implements support for errors.Is and errors.As on the last error returned by fetch
+func (e *FetchContractError) Unwrap() error {
+	return e.LastErr
 }
 
 // ErrNotFound is generated for you when using NewMappedLoader and not returning any data for a given key
 var ErrNotFound = errors.New("dataloadgen: not found")
 
 // ErrorSlice represents a list of errors that contains at least one error
+//
+// Deprecated: LoadAll and LoadAllThunk return KeyedErrors.
 type ErrorSlice []error
 
 // Error implements the error interface
@@ -231,6 +942,68 @@ func (e ErrorSlice) Unwrap() error {
 	return errors.Join([]error(e)...)
 }
 
+// KeyedErrors maps the keys that failed to load to their errors. It's returned by LoadAll and
+// LoadAllThunk when at least one key failed.
+type KeyedErrors[KeyT comparable] map[KeyT]error
+
+// Error implements the error interface
+func (e KeyedErrors[KeyT]) Error() string {
+	// sort by key so that the message doesn't depend on map order
+	keys := make([]string, 0, len(e))
+	errs := make(map[string]error, len(e))
+	for k, v := range e {
+		key := fmt.Sprint(k)
+		keys = append(keys, key)
+		errs[key] = v
+	}
+	sort.Strings(keys)
+	var errSlice = make([]string, 0, len(e))
+	for _, key := range keys {
+		errSlice = append(errSlice, fmt.Sprint(key, ": ", errs[key]))
+	}
+	return fmt.Sprint("Keyed errors: [", strings.Join(errSlice, ", "), "]")
+}
+
+// Unwrap implements support for errors.Is and errors.As
+func (e KeyedErrors[KeyT]) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Failed returns the keys that failed to load
+func (e KeyedErrors[KeyT]) Failed() []KeyT {
+	keys := make([]KeyT, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// NotFound returns the keys that failed to load with ErrNotFound
+func (e KeyedErrors[KeyT]) NotFound() []KeyT {
+	var keys []KeyT
+	for key, err := range e {
+		if errors.Is(err, ErrNotFound) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Only reports whether every key failed with target, as reported by errors.Is.
+// For example, Only(ErrNotFound) is true if the only problem was missing data.
+func (e KeyedErrors[KeyT]) Only(target error) bool {
+	for _, err := range e {
+		if !errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
+
 // LoadAll fetches many keys at once. It will be broken into appropriate sized
 // sub batches depending on how the loader is configured
 func (l *Loader[KeyT, ValueT]) LoadAll(ctx context.Context, keys []KeyT) ([]ValueT, error) {
@@ -240,19 +1013,7 @@ func (l *Loader[KeyT, ValueT]) LoadAll(ctx context.Context, keys []KeyT) ([]Valu
 		thunks[i] = l.LoadThunk(ctx, key)
 	}
 
-	values := make([]ValueT, len(keys))
-	errs := make([]error, len(keys))
-	allNil := true
-	for i, thunk := range thunks {
-		values[i], errs[i] = thunk()
-		if errs[i] != nil {
-			allNil = false
-		}
-	}
-	if allNil {
-		return values, nil
-	}
-	return values, ErrorSlice(errs)
+	return waitAll(keys, thunks)
 }
 
 // LoadAllThunk returns a function that when called will block waiting for a ValueT.
@@ -264,63 +1025,242 @@ func (l *Loader[KeyT, ValueT]) LoadAllThunk(ctx context.Context, keys []KeyT) fu
 		thunks[i] = l.LoadThunk(ctx, key)
 	}
 	return func() ([]ValueT, error) {
-		values := make([]ValueT, len(keys))
-		errs := make([]error, len(keys))
-		allNil := true
-		for i, thunk := range thunks {
-			values[i], errs[i] = thunk()
-			if allNil && errs[i] != nil {
-				allNil = false
+		return waitAll(keys, thunks)
+	}
+}
+
+// waitAll calls the thunks of keys and returns their values, and KeyedErrors if any of them failed
+func waitAll[KeyT comparable, ValueT any](keys []KeyT, thunks []func() (ValueT, error)) ([]ValueT, error) {
+	values := make([]ValueT, len(keys))
+	var errs KeyedErrors[KeyT]
+	for i, thunk := range thunks {
+		var err error
+		values[i], err = thunk()
+		if err != nil {
+			if errs == nil {
+				errs = KeyedErrors[KeyT]{}
 			}
+			errs[keys[i]] = err
 		}
-		if allNil {
-			return values, nil
+	}
+	if errs == nil {
+		return values, nil
+	}
+	return values, errs
+}
+
+// Result is the value or the error loaded for a single key
+type Result[ValueT any] struct {
+	Value ValueT
+	Err   error
+}
+
+// LoadAllResults fetches many keys at once like LoadAll, but returns the value and error of each key
+// together, in the same order as keys.
+func (l *Loader[KeyT, ValueT]) LoadAllResults(ctx context.Context, keys []KeyT) []Result[ValueT] {
+	thunks := make([]func() (ValueT, error), len(keys))
+	for i, key := range keys {
+		thunks[i] = l.LoadThunk(ctx, key)
+	}
+
+	results := make([]Result[ValueT], len(keys))
+	for i, thunk := range thunks {
+		results[i].Value, results[i].Err = thunk()
+	}
+	return results
+}
+
+// LoadMap fetches many keys at once like LoadAll, but returns maps from keys to values and errors.
+// Keys that failed to load only appear in the error map, which is nil if there were no errors.
+func (l *Loader[KeyT, ValueT]) LoadMap(ctx context.Context, keys []KeyT) (map[KeyT]ValueT, map[KeyT]error) {
+	results := l.LoadAllResults(ctx, keys)
+	values := make(map[KeyT]ValueT, len(keys))
+	var errs map[KeyT]error
+	for i, result := range results {
+		if result.Err != nil {
+			if errs == nil {
+				errs = map[KeyT]error{}
+			}
+			errs[keys[i]] = result.Err
+			continue
 		}
-		return values, ErrorSlice(errs)
+		values[keys[i]] = result.Value
 	}
+	return values, errs
+}
+
+// Stats counts how the loader's cache has been used
+type Stats struct {
+	// Hits is the number of loads served from the cache, including keys that were still being fetched
+	Hits int64
+	// NegativeHits is the number of loads served from the cache with ErrNotFound. They're not counted in Hits.
+	NegativeHits int64
+	// Misses is the number of loads that added their key to a batch
+	Misses int64
+}
+
+// Stats returns the loader's cache statistics
+func (l *Loader[KeyT, ValueT]) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
 }
 
 // Prime the cache with the provided key and value. If the key already exists, no change is made
 // and false is returned.
-// (To forcefully prime the cache, clear the key first with loader.Clear(key).Prime(key, value).)
+// (To forcefully prime the cache, use Set.)
+// If the loader is partitioned, the value is shared by all partitions that haven't loaded key themselves.
 func (l *Loader[KeyT, ValueT]) Prime(key KeyT, value ValueT) bool {
+	if l.normalize != nil {
+		key = l.normalize(key)
+	}
 	l.mu.Lock()
-	var found bool
-	if _, found = l.thunkCache[key]; !found {
-		l.thunkCache[key] = func() (ValueT, error) { return value, nil }
+	defer l.mu.Unlock()
+	if entry, found := l.cache[key]; found && !entry.expired() {
+		return false
 	}
-	l.mu.Unlock()
-	return !found
+	l.cache[key] = &loaderEntry[KeyT, ValueT]{key: key, value: value, done: closedChan}
+	return true
+}
+
+// Set the value at key in the cache, replacing any existing value. Callers that are still waiting
+// for key to be fetched get value instead of the result of the fetch.
+// If the loader is partitioned, value replaces the value of key in every partition, so every tenant
+// sees it. Use SetInPartition to only set it for the partition of a caller.
+func (l *Loader[KeyT, ValueT]) Set(key KeyT, value ValueT) {
+	if l.normalize != nil {
+		key = l.normalize(key)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for partition, entries := range l.partitions {
+		l.replace(entries, key, value)
+		if len(entries) == 0 {
+			delete(l.partitions, partition)
+		}
+	}
+	l.setEntry(l.cache, key, value)
+}
+
+// SetInPartition is like Set, but if the loader is partitioned, it only replaces the value of key in
+// the partition of ctx. Other partitions keep their values.
+func (l *Loader[KeyT, ValueT]) SetInPartition(ctx context.Context, key KeyT, value ValueT) {
+	var partition any
+	if l.partition != nil {
+		partition = l.partition(ctx)
+	}
+	l.setPartition(partition, key, value)
+}
+
+// setPartition is like Set, but only replaces the value of key in partition
+func (l *Loader[KeyT, ValueT]) setPartition(partition any, key KeyT, value ValueT) {
+	if l.normalize != nil {
+		key = l.normalize(key)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setEntry(l.entries(partition), key, value)
+}
+
+// setEntry replaces the entry for key in entries with one for value. It must be called with the mutex held.
+func (l *Loader[KeyT, ValueT]) setEntry(entries map[KeyT]*loaderEntry[KeyT, ValueT], key KeyT, value ValueT) {
+	l.replace(entries, key, value)
+	entries[key] = &loaderEntry[KeyT, ValueT]{key: key, value: value, done: closedChan}
+}
+
+// replace removes the entry for key from entries. If the entry is still being fetched, its callers
+// get value instead. It must be called with the mutex held.
+func (l *Loader[KeyT, ValueT]) replace(entries map[KeyT]*loaderEntry[KeyT, ValueT], key KeyT, value ValueT) {
+	entry, ok := entries[key]
+	if !ok {
+		return
+	}
+	delete(entries, key)
+	if entry.batch != nil && !entry.set {
+		select {
+		case <-entry.done:
+		default:
+			entry.value, entry.err = value, nil
+			entry.set = true
+			close(entry.done)
+		}
+	}
+}
+
+// WriteThrough calls write, which should perform a mutation and return the new value at key, and
+// then sets the value in the cache with SetInPartition, so it's only seen by the partition of ctx.
+// If write fails, its error is returned and the cache isn't changed.
+func (l *Loader[KeyT, ValueT]) WriteThrough(ctx context.Context, key KeyT, write func(ctx context.Context) (ValueT, error)) (ValueT, error) {
+	value, err := write(ctx)
+	if err != nil {
+		return value, err
+	}
+	l.SetInPartition(ctx, key, value)
+	return value, nil
 }
 
-// Clear the value at key from the cache, if it exists
+// Clear the value at key from the cache, if it exists. If the loader is partitioned, the value is
+// cleared from every partition.
 func (l *Loader[KeyT, ValueT]) Clear(key KeyT) {
+	if l.normalize != nil {
+		key = l.normalize(key)
+	}
 	l.mu.Lock()
-	delete(l.thunkCache, key)
+	delete(l.cache, key)
+	for partition, entries := range l.partitions {
+		delete(entries, key)
+		if len(entries) == 0 {
+			delete(l.partitions, partition)
+		}
+	}
 	l.mu.Unlock()
 }
 
 // ClearAll clears all values from the cache
 func (l *Loader[KeyT, ValueT]) ClearAll() {
 	l.mu.Lock()
-	l.thunkCache = make(map[KeyT]func() (ValueT, error))
+	l.cache = make(map[KeyT]*loaderEntry[KeyT, ValueT])
+	l.partitions = nil
 	l.mu.Unlock()
 }
 
-func (l *Loader[KeyT, ValueT]) startBatch(ctx context.Context) {
-	if l.batch == nil {
-		batch := &loaderBatch[KeyT, ValueT]{
-			done:         make(chan struct{}),
+// Flush dispatches all of the pending batches without waiting for the time set by WithWait. It
+// doesn't wait for them to be fetched.
+func (l *Loader[KeyT, ValueT]) Flush() {
+	l.mu.Lock()
+	batches := make([]*loaderBatch[KeyT, ValueT], 0, len(l.batches))
+	for _, b := range l.batches {
+		batches = append(batches, b)
+	}
+	for _, b := range batches {
+		l.dispatch(b, DispatchManual)
+	}
+	l.mu.Unlock()
+	for _, b := range batches {
+		go l.fetchBatch(b)
+	}
+}
+
+// startBatch returns the current batch for bk, starting a new one if there isn't one
+func (l *Loader[KeyT, ValueT]) startBatch(ctx context.Context, bk batchKey) *loaderBatch[KeyT, ValueT] {
+	batch, ok := l.batches[bk]
+	if !ok {
+		batch = &loaderBatch[KeyT, ValueT]{
+			key:          bk,
 			firstContext: ctx,
 		}
+		batch.callers.add(ctx)
 		if l.maxBatch != 0 {
 			batch.contexts = make([]context.Context, 0)
-			batch.keys = make([]KeyT, 0)
+			batch.entries = make([]*loaderEntry[KeyT, ValueT], 0)
 			if l.tracer != nil {
 				batch.spans = make([]trace.Span, 0)
 			}
 		}
-		l.batch = batch
+		l.batches[bk] = batch
+		for _, o := range l.observers {
+			o.BatchCreated(ctx)
+		}
 		go func(l *Loader[KeyT, ValueT]) {
 			time.Sleep(l.wait)
 			l.mu.Lock()
@@ -331,76 +1271,237 @@ func (l *Loader[KeyT, ValueT]) startBatch(ctx context.Context) {
 				return
 			}
 
-			ctxs := l.batch.contexts
-			spans := l.batch.spans
-
-			l.batch = nil
+			l.dispatch(batch, DispatchTimeLimit)
 			l.mu.Unlock()
 
-			if l.tracer != nil {
-				for _, ctx := range ctxs {
-					_, span := l.tracer.Start(ctx, "dataloadgen.fetch.timelimit",
-						trace.WithAttributes(
-							attribute.Int64("dataloadgen.keys", int64(len(batch.keys)))))
-					defer span.End()
+			l.fetchBatch(batch)
+		}(l)
+	}
+	return batch
+}
+
+// dispatch stops the batch from accepting more keys and prunes the keys that have no live waiters.
+// It must be called with the mutex held.
+func (l *Loader[KeyT, ValueT]) dispatch(b *loaderBatch[KeyT, ValueT], reason DispatchReason) {
+	b.fetchExecuted = true
+	b.reason = reason
+	if l.batches[b.key] == b {
+		delete(l.batches, b.key)
+	}
+	live := b.entries[:0]
+	for _, entry := range b.entries {
+		if entry.dropped {
+			continue
+		}
+		if entry.set {
+			if l.onDrop != nil {
+				l.onDrop(entry.key)
+			}
+			continue
+		}
+		if !entry.live() {
+			l.drop(entry)
+			continue
+		}
+		// the waiters are only needed while the batch is pending
+		entry.waiters = callerContexts{}
+		live = append(live, entry)
+	}
+	b.entries = live
+	for _, o := range l.observers {
+		o.BatchDispatched(b.firstContext, len(b.entries), reason)
+	}
+}
+
+// fetchBatch calls fetch for a dispatched batch and hands the results out to its entries
+func (l *Loader[KeyT, ValueT]) fetchBatch(b *loaderBatch[KeyT, ValueT]) {
+	var fetchSpans []trace.Span
+	if l.tracer != nil {
+		for _, ctx := range b.contexts {
+			_, span := l.tracer.Start(ctx, "dataloadgen.fetch."+b.reason.String(),
+				trace.WithAttributes(
+					attribute.Int64("dataloadgen.keys", int64(len(b.entries)))))
+			defer span.End()
+			fetchSpans = append(fetchSpans, span)
+		}
+	}
+
+	if len(b.entries) > 0 {
+		if l.keyLess != nil {
+			// entries get their results by position, so sorting them sorts the keys
+			sort.SliceStable(b.entries, func(i, j int) bool { return l.keyLess(b.entries[i].key, b.entries[j].key) })
+		}
+		keys := make([]KeyT, len(b.entries))
+		for i, entry := range b.entries {
+			keys[i] = entry.key
+		}
+		fetchCtx, release := l.batchContext(b)
+		start := time.Now()
+		results, errs := l.safeFetch(fetchCtx, keys)
+		duration := time.Since(start)
+		release()
+		result := splitResults(len(b.entries), results, errs)
+
+		// entries can be Set as soon as the mutex is released, so the hooks get copies of the results
+		var loaded []loadedKey[KeyT, ValueT]
+		l.mu.Lock()
+		for i, entry := range b.entries {
+			// entries that were Set while the fetch ran already have a newer value
+			if !entry.set {
+				entry.value, entry.err = result(i)
+				if entry.err == nil {
+					loaded = append(loaded, loadedKey[KeyT, ValueT]{entry.key, entry.value})
+				}
+				if _, ok := entry.err.(*PanicError); ok {
+					// only the callers of this batch get the panic, later ones fetch again
+					l.uncache(entry)
+				}
+				if entry.err != nil && errors.Is(entry.err, ErrNotFound) {
+					entry.notFound = true
+					if l.negativeCache {
+						entry.expires = time.Now().Add(l.negativeTTL)
+						entry := entry
+						time.AfterFunc(l.negativeTTL, func() {
+							l.mu.Lock()
+							l.uncache(entry)
+							l.mu.Unlock()
+						})
+					}
+				}
+			}
+		}
+		onResult := l.onResult
+		l.mu.Unlock()
+		if len(l.observers) != 0 || l.metrics != nil {
+			failed := 0
+			for i := range b.entries {
+				if _, err := result(i); err != nil {
+					failed++
 				}
 			}
+			for _, o := range l.observers {
+				o.FetchCompleted(b.firstContext, len(b.entries), duration, failed)
+			}
+			if l.metrics != nil {
+				l.metrics.batchSize.Record(b.firstContext, int64(len(b.entries)), l.metrics.attrs)
+				l.metrics.fetchDuration.Record(b.firstContext, duration.Seconds(), l.metrics.attrs)
+				l.metrics.fetchErrors.Add(b.firstContext, int64(failed), l.metrics.attrs)
+			}
+		}
+		for _, f := range onResult {
+			for _, k := range loaded {
+				f(b.key.partition, k.key, k.value)
+			}
+		}
 
-			batch.results, batch.errors = l.safeFetch(batch.firstContext, batch.keys)
+		var enqueued []time.Time
+		l.mu.Lock()
+		for _, entry := range b.entries {
+			if !entry.set {
+				close(entry.done)
+				if l.metrics != nil {
+					enqueued = append(enqueued, entry.enqueued)
+				}
+			}
+		}
+		l.mu.Unlock()
+		if l.metrics != nil {
+			now := time.Now()
+			for _, t := range enqueued {
+				l.metrics.keyWait.Record(b.firstContext, now.Sub(t).Seconds(), l.metrics.attrs)
+			}
+		}
 
-			if l.tracer != nil {
-				for _, span := range spans {
-					span.End()
+		if len(errs) == 1 {
+			if panicErr, ok := errs[0].(*PanicError); ok {
+				for _, span := range fetchSpans {
+					span.RecordError(panicErr, trace.WithAttributes(
+						attribute.String("exception.stacktrace", string(panicErr.Stack))))
+					span.SetStatus(codes.Error, panicErr.Error())
 				}
 			}
+		}
+	}
 
-			close(batch.done)
-		}(l)
+	if l.tracer != nil {
+		for _, span := range b.spans {
+			span.End()
+		}
 	}
 }
 
+// loadedKey is a key and the value a batch loaded for it
+type loadedKey[KeyT comparable, ValueT any] struct {
+	key   KeyT
+	value ValueT
+}
+
+// splitResults checks the values and errors that a batch function returned for n keys and returns
+// a function that gives the value and error of the key at each position
+func splitResults[ValueT any](n int, results []ValueT, errs []error) func(i int) (ValueT, error) {
+	var valuesErr, errorsErr error
+	// If the batch function returned the wrong number of responses, return an error to all callers
+	if len(results) != n {
+		valuesErr = &FetchContractError{Violation: WrongValueCount, Keys: n, Returned: len(results)}
+	}
+	if len(errs) != 0 && len(errs) < n {
+		errorsErr = &FetchContractError{Violation: WrongErrorCount, Keys: n, Returned: len(errs), LastErr: errs[len(errs)-1]}
+	}
+
+	return func(i int) (value ValueT, err error) {
+		// Return early if there's a single error and it's not nil
+		if len(errs) == 1 && errs[0] != nil {
+			return value, errs[0]
+		}
+
+		if valuesErr != nil {
+			return value, valuesErr
+		}
+
+		value = results[i]
+
+		if len(errs) != 0 {
+			if i < len(errs) {
+				err = errs[i]
+			} else {
+				err = errorsErr
+			}
+		}
+		return value, err
+	}
+}
+
+// batchContext returns the context to fetch the batch with and a function to call once the fetch is done
+func (l *Loader[KeyT, ValueT]) batchContext(b *loaderBatch[KeyT, ValueT]) (context.Context, func()) {
+	var ctx context.Context
+	var release func()
+	if l.fetchContext == MergedContext {
+		ctx, release = mergeContexts(b.callers.ctxs)
+	} else {
+		ctx, release = context.WithCancel(b.firstContext)
+	}
+	if l.shard != nil {
+		ctx = context.WithValue(ctx, shardKey{}, b.key.shard)
+	}
+	return ctx, release
+}
+
 func (l *Loader[KeyT, ValueT]) safeFetch(ctx context.Context, keys []KeyT) (values []ValueT, errs []error) {
 	defer func() {
 		panicValue := recover()
 		if panicValue != nil {
-			errs = []error{fmt.Errorf("panic during fetch: %v", panicValue)}
+			errs = []error{&PanicError{Value: panicValue, Stack: debug.Stack()}}
 		}
 	}()
 	return l.fetch(ctx, keys)
 }
 
-// addKeyToBatch will return the location of the key in the batch, if it's not found
-// it will add the key to the batch
-func (l *Loader[KeyT, ValueT]) addKeyToBatch(b *loaderBatch[KeyT, ValueT], key KeyT) int {
-	pos := len(b.keys)
-	b.keys = append(b.keys, key)
-
-	if l.maxBatch != 0 && pos >= l.maxBatch-1 {
-		ctxs := l.batch.contexts
-		spans := l.batch.spans
-		b.fetchExecuted = true
-		l.batch = nil
-		go func(l *Loader[KeyT, ValueT], ctxs []context.Context) {
-			if l.tracer != nil {
-				for _, ctx := range ctxs {
-					_, span := l.tracer.Start(ctx, "dataloadgen.fetch.keylimit",
-						trace.WithAttributes(
-							attribute.Int64("dataloadgen.keys", int64(len(b.keys)))))
-					defer span.End()
-				}
-			}
-
-			b.results, b.errors = l.safeFetch(b.firstContext, b.keys)
-
-			if l.tracer != nil {
-				for _, span := range spans {
-					span.End()
-				}
-			}
+// addEntryToBatch adds the entry to the batch and dispatches the batch if it's full
+func (l *Loader[KeyT, ValueT]) addEntryToBatch(b *loaderBatch[KeyT, ValueT], entry *loaderEntry[KeyT, ValueT]) {
+	b.entries = append(b.entries, entry)
 
-			close(b.done)
-		}(l, ctxs)
+	if l.maxBatch != 0 && len(b.entries) >= l.maxBatch {
+		l.dispatch(b, DispatchKeyLimit)
+		go l.fetchBatch(b)
 	}
-
-	return pos
 }
@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel/metric/noop"
+
 	"github.com/vikstrous/dataloadgen"
 )
 
@@ -115,23 +119,23 @@ func TestErrors(t *testing.T) {
 		dataloadgen.WithBatchCapacity(3),
 	)
 	_, err := dl.LoadAll(ctx, []int{1, 2, 3})
-	var errs dataloadgen.ErrorSlice
+	var errs dataloadgen.KeyedErrors[int]
 	errors.As(err, &errs)
 	if len(errs) != 3 {
 		t.Fatalf("wrong number of errors: %d", len(errs))
 	}
-	if errs[0].Error() != "error 1" {
-		t.Fatalf("wrong error: %s", errs[0].Error())
-	}
-	if errs[1].Error() != "error 2" {
+	if errs[1].Error() != "error 1" {
 		t.Fatalf("wrong error: %s", errs[1].Error())
 	}
-	if errs[2].Error() != "bug in fetch function: 2 errors returned for 3 keys; last error: error 2" {
+	if errs[2].Error() != "error 2" {
 		t.Fatalf("wrong error: %s", errs[2].Error())
 	}
+	if errs[3].Error() != "bug in fetch function: 2 errors returned for 3 keys; last error: error 2" {
+		t.Fatalf("wrong error: %s", errs[3].Error())
+	}
 }
 
-func TestErrorSliceUnwrap(t *testing.T) {
+func TestKeyedErrorsUnwrap(t *testing.T) {
 	ctx := context.Background()
 	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
 		return []string{"1", "2", "3"}, []error{fmt.Errorf("error 1"), context.Canceled}
@@ -231,3 +235,972 @@ func TestMappedLoaderNotFoundError(t *testing.T) {
 		t.Fatalf("Wrong error returned: %T", err)
 	}
 }
+
+type ctxKey struct{}
+
+func TestMergedFetchContext(t *testing.T) {
+	fetchCtxs := make(chan context.Context, 1)
+	dl := dataloadgen.NewLoader(func(ctx context.Context, keys []int) ([]int, []error) {
+		fetchCtxs <- ctx
+		<-ctx.Done()
+		return keys, nil
+	},
+		dataloadgen.WithWait(5*time.Millisecond),
+	)
+
+	ctx1, cancel1 := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "first"))
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	thunk1 := dl.LoadThunk(ctx1, 1)
+	thunk2 := dl.LoadThunk(ctx2, 2)
+
+	fetchCtx := <-fetchCtxs
+	if fetchCtx.Value(ctxKey{}) != "first" {
+		t.Fatal("fetch context doesn't carry values from the first context")
+	}
+	cancel1()
+	select {
+	case <-fetchCtx.Done():
+		t.Fatal("fetch context cancelled while a caller is still waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel2()
+	<-fetchCtx.Done()
+	if !errors.Is(fetchCtx.Err(), context.Canceled) {
+		t.Fatalf("wrong error: %v", fetchCtx.Err())
+	}
+	thunk1()
+	thunk2()
+}
+
+func TestFetchContextDoneAfterFetch(t *testing.T) {
+	for name, tc := range map[string]struct {
+		secondCaller func() (context.Context, context.CancelFunc)
+		options      []dataloadgen.Option
+	}{
+		"merged cancellable": {
+			secondCaller: func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+		},
+		"merged background": {
+			secondCaller: func() (context.Context, context.CancelFunc) { return context.Background(), func() {} },
+		},
+		"single caller": {},
+		"first context": {
+			secondCaller: func() (context.Context, context.CancelFunc) { return context.Background(), func() {} },
+			options:      []dataloadgen.Option{dataloadgen.WithFetchContext(dataloadgen.FirstContext)},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			fetchCtxs := make(chan context.Context, 1)
+			dl := dataloadgen.NewLoader(func(ctx context.Context, keys []int) ([]int, []error) {
+				fetchCtxs <- ctx
+				return keys, nil
+			}, append(tc.options, dataloadgen.WithWait(5*time.Millisecond))...)
+
+			ctx1, cancel1 := context.WithCancel(context.Background())
+			defer cancel1()
+			thunks := []func() (int, error){dl.LoadThunk(ctx1, 1)}
+			if tc.secondCaller != nil {
+				ctx2, cancel2 := tc.secondCaller()
+				defer cancel2()
+				thunks = append(thunks, dl.LoadThunk(ctx2, 2))
+			}
+			for _, thunk := range thunks {
+				thunk()
+			}
+
+			// work started with the fetch context must not outlive the fetch
+			fetchCtx := <-fetchCtxs
+			select {
+			case <-fetchCtx.Done():
+			case <-time.After(time.Second):
+				t.Fatal("fetch context not done after the fetch")
+			}
+			if !errors.Is(fetchCtx.Err(), context.Canceled) {
+				t.Fatalf("wrong error: %v", fetchCtx.Err())
+			}
+		})
+	}
+}
+
+func TestFirstFetchContext(t *testing.T) {
+	fetchCtxs := make(chan context.Context, 1)
+	dl := dataloadgen.NewLoader(func(ctx context.Context, keys []int) ([]int, []error) {
+		fetchCtxs <- ctx
+		<-ctx.Done()
+		return keys, nil
+	},
+		dataloadgen.WithWait(5*time.Millisecond),
+		dataloadgen.WithFetchContext(dataloadgen.FirstContext),
+	)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	thunk1 := dl.LoadThunk(ctx1, 1)
+	thunk2 := dl.LoadThunk(context.Background(), 2)
+
+	fetchCtx := <-fetchCtxs
+	cancel1()
+	<-fetchCtx.Done()
+	thunk1()
+	thunk2()
+}
+
+// taggedContext isn't comparable because it holds a slice
+type taggedContext struct {
+	context.Context
+	tags []string
+}
+
+func TestUncomparableCallerContexts(t *testing.T) {
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]int, []error) {
+		return keys, nil
+	}, dataloadgen.WithWait(5*time.Millisecond))
+
+	thunk1 := dl.LoadThunk(taggedContext{context.Background(), []string{"a"}}, 1)
+	thunk2 := dl.LoadThunk(taggedContext{context.Background(), []string{"b"}}, 2)
+	if v, err := thunk1(); v != 1 || err != nil {
+		t.Fatal("wrong result", v, err)
+	}
+	if v, err := thunk2(); v != 2 || err != nil {
+		t.Fatal("wrong result", v, err)
+	}
+}
+
+func TestUncomparableWaiterContexts(t *testing.T) {
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]int, []error) {
+		return keys, nil
+	}, dataloadgen.WithWait(5*time.Millisecond))
+
+	// both callers wait for the same pending entry
+	thunk1 := dl.LoadThunk(taggedContext{context.Background(), []string{"a"}}, 1)
+	thunk2 := dl.LoadThunk(taggedContext{context.Background(), []string{"b"}}, 1)
+	if v, err := thunk1(); v != 1 || err != nil {
+		t.Fatal("wrong result", v, err)
+	}
+	if v, err := thunk2(); v != 1 || err != nil {
+		t.Fatal("wrong result", v, err)
+	}
+}
+
+func TestLoadReturnsWhenContextDone(t *testing.T) {
+	release := make(chan struct{})
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]int, []error) {
+		<-release
+		return keys, nil
+	},
+		dataloadgen.WithWait(time.Millisecond),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	thunk1 := dl.LoadThunk(ctx, 1)
+	thunk2 := dl.LoadThunk(context.Background(), 2)
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+
+	if _, err := thunk1(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	close(release)
+	v, err := thunk2()
+	if err != nil || v != 2 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	// the batch was already dispatched, so the result is still cached
+	v, err = dl.Load(context.Background(), 1)
+	if err != nil || v != 1 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+}
+
+func TestCancelledKeyDroppedFromBatch(t *testing.T) {
+	var fetches [][]int
+	var mu sync.Mutex
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]int, []error) {
+		mu.Lock()
+		fetches = append(fetches, keys)
+		mu.Unlock()
+		return keys, nil
+	},
+		dataloadgen.WithWait(20*time.Millisecond),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelledThunk := dl.LoadThunk(ctx, 1)
+	sharedThunk1 := dl.LoadThunk(ctx, 2)
+	sharedThunk2 := dl.LoadThunk(context.Background(), 2)
+	thunk3 := dl.LoadThunk(context.Background(), 3)
+	cancel()
+	if _, err := cancelledThunk(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if _, err := sharedThunk1(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if v, err := sharedThunk2(); err != nil || v != 2 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	if v, err := thunk3(); err != nil || v != 3 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	if _, err := cancelledThunk(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error after the batch is done: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetches) != 1 || len(fetches[0]) != 2 || fetches[0][0] != 2 || fetches[0][1] != 3 {
+		t.Fatal("cancelled key was fetched", fetches)
+	}
+}
+
+func TestKeysWithoutLiveWaitersPruned(t *testing.T) {
+	var fetches [][]int
+	var mu sync.Mutex
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]int, []error) {
+		mu.Lock()
+		fetches = append(fetches, keys)
+		mu.Unlock()
+		return keys, nil
+	},
+		dataloadgen.WithWait(5*time.Millisecond),
+	)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	// nobody calls these thunks, so only the pruning at dispatch can drop their keys
+	dl.LoadThunk(ctx1, 1)
+	dl.LoadThunk(ctx1, 2)
+	dl.LoadThunk(ctx2, 2)
+	thunk3 := dl.LoadThunk(ctx2, 3)
+	cancel1()
+
+	if v, err := thunk3(); err != nil || v != 3 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	cancel2()
+
+	mu.Lock()
+	if len(fetches) != 1 || len(fetches[0]) != 2 || fetches[0][0] != 2 || fetches[0][1] != 3 {
+		t.Fatal("wrong keys fetched", fetches)
+	}
+	mu.Unlock()
+
+	// the pruned key is fetched again by the next caller
+	if v, err := dl.Load(context.Background(), 1); err != nil || v != 1 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+}
+
+func TestBatchPartition(t *testing.T) {
+	var fetches []string
+	var mu sync.Mutex
+	dl := dataloadgen.NewLoader(func(ctx context.Context, keys []int) ([]string, []error) {
+		tenant := ctx.Value(ctxKey{}).(string)
+		mu.Lock()
+		fetches = append(fetches, fmt.Sprint(tenant, keys))
+		mu.Unlock()
+		results := make([]string, len(keys))
+		for i, key := range keys {
+			results[i] = fmt.Sprint(tenant, key)
+		}
+		return results, nil
+	},
+		dataloadgen.WithWait(5*time.Millisecond),
+		dataloadgen.WithBatchPartition(func(ctx context.Context) any {
+			return ctx.Value(ctxKey{})
+		}),
+	)
+
+	ctxA := context.WithValue(context.Background(), ctxKey{}, "a")
+	ctxB := context.WithValue(context.Background(), ctxKey{}, "b")
+	thunkA1 := dl.LoadThunk(ctxA, 1)
+	thunkB1 := dl.LoadThunk(ctxB, 1)
+	thunkA2 := dl.LoadThunk(ctxA, 2)
+	if v, err := thunkA1(); err != nil || v != "a1" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	if v, err := thunkB1(); err != nil || v != "b1" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	if v, err := thunkA2(); err != nil || v != "a2" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetches) != 2 {
+		t.Fatal("wrong number of fetches", fetches)
+	}
+	if !(fetches[0] == "a[1 2]" && fetches[1] == "b[1]") && !(fetches[0] == "b[1]" && fetches[1] == "a[1 2]") {
+		t.Fatal("wrong fetches", fetches)
+	}
+}
+
+func TestBatchPartitionCache(t *testing.T) {
+	var fetches int32
+	dl := dataloadgen.NewLoader(func(ctx context.Context, keys []int) ([]string, []error) {
+		atomic.AddInt32(&fetches, 1)
+		results := make([]string, len(keys))
+		for i, key := range keys {
+			results[i] = fmt.Sprint(ctx.Value(ctxKey{}), key)
+		}
+		return results, nil
+	},
+		dataloadgen.WithWait(time.Millisecond),
+		dataloadgen.WithBatchPartition(func(ctx context.Context) any {
+			return ctx.Value(ctxKey{})
+		}),
+	)
+	ctxA := context.WithValue(context.Background(), ctxKey{}, "a")
+	ctxB := context.WithValue(context.Background(), ctxKey{}, "b")
+	load := func(ctx context.Context, key int, want string) {
+		t.Helper()
+		if v, err := dl.Load(ctx, key); err != nil || v != want {
+			t.Fatalf("wrong value/err: %v %v", v, err)
+		}
+	}
+
+	// partitions don't evict each other's entries
+	for i := 0; i < 3; i++ {
+		load(ctxA, 1, "a1")
+		load(ctxB, 1, "b1")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatal("wrong number of fetches", n)
+	}
+
+	// primed values are shared by partitions that haven't loaded the key
+	if !dl.Prime(2, "primed") {
+		t.Fatal("prime failed")
+	}
+	load(ctxA, 2, "primed")
+	load(ctxB, 2, "primed")
+
+	// Set and Clear apply to every partition
+	dl.Set(1, "set")
+	load(ctxA, 1, "set")
+	load(ctxB, 1, "set")
+	dl.Clear(1)
+	load(ctxA, 1, "a1")
+	load(ctxB, 1, "b1")
+
+	// SetInPartition and WriteThrough only apply to the partition of their context
+	dl.SetInPartition(ctxA, 1, "a set")
+	load(ctxA, 1, "a set")
+	load(ctxB, 1, "b1")
+	v, err := dl.WriteThrough(ctxB, 1, func(ctx context.Context) (string, error) {
+		return "b written", nil
+	})
+	if err != nil || v != "b written" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	load(ctxA, 1, "a set")
+	load(ctxB, 1, "b written")
+	if n := atomic.LoadInt32(&fetches); n != 4 {
+		t.Fatal("wrong number of fetches", n)
+	}
+}
+
+func TestShardFunc(t *testing.T) {
+	var fetches []string
+	var mu sync.Mutex
+	dl := dataloadgen.NewLoader(func(ctx context.Context, keys []int) ([]int, []error) {
+		shard, _ := dataloadgen.ShardFromContext(ctx)
+		mu.Lock()
+		fetches = append(fetches, fmt.Sprint(shard, keys))
+		mu.Unlock()
+		return keys, nil
+	},
+		dataloadgen.WithWait(5*time.Millisecond),
+		dataloadgen.WithShardFunc(func(key int) string {
+			if key%2 == 0 {
+				return "even"
+			}
+			return "odd"
+		}),
+	)
+
+	values, err := dl.LoadAll(context.Background(), []int{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != "[1 2 3 4]" {
+		t.Fatal("wrong values", values)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetches) != 2 {
+		t.Fatal("wrong number of fetches", fetches)
+	}
+	if !(fetches[0] == "odd[1 3]" && fetches[1] == "even[2 4]") && !(fetches[0] == "even[2 4]" && fetches[1] == "odd[1 3]") {
+		t.Fatal("wrong fetches", fetches)
+	}
+}
+
+func TestShardFuncWrongKeyType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	dataloadgen.NewLoader(func(ctx context.Context, keys []int) ([]int, []error) {
+		return keys, nil
+	},
+		dataloadgen.WithShardFunc(func(key string) string { return key }),
+	)
+}
+
+func TestLoadAllResultsAndLoadMap(t *testing.T) {
+	ctx := context.Background()
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []string) (ret []int, errs []error) {
+		for _, key := range keys {
+			num, err := strconv.Atoi(key)
+			ret = append(ret, num)
+			errs = append(errs, err)
+		}
+		return
+	})
+
+	results := dl.LoadAllResults(ctx, []string{"1", "x", "3"})
+	if len(results) != 3 {
+		t.Fatal("wrong number of results", results)
+	}
+	if results[0].Value != 1 || results[0].Err != nil || results[2].Value != 3 || results[2].Err != nil {
+		t.Fatal("wrong results", results)
+	}
+	if results[1].Err == nil {
+		t.Fatal("expected error")
+	}
+
+	values, errs := dl.LoadMap(ctx, []string{"1", "x", "4"})
+	if len(values) != 2 || values["1"] != 1 || values["4"] != 4 {
+		t.Fatal("wrong values", values)
+	}
+	if len(errs) != 1 || errs["x"] == nil {
+		t.Fatal("wrong errors", errs)
+	}
+
+	_, errs = dl.LoadMap(ctx, []string{"1"})
+	if errs != nil {
+		t.Fatal("expected no errors", errs)
+	}
+}
+
+func TestKeyedErrorsHelpers(t *testing.T) {
+	ctx := context.Background()
+	dl := dataloadgen.NewMappedLoader(func(_ context.Context, keys []string) (map[string]int, error) {
+		return map[string]int{"1": 1}, dataloadgen.MappedFetchError[string]{"bad": errors.New("bad key")}
+	})
+
+	_, err := dl.LoadAll(ctx, []string{"1", "2", "3"})
+	var errs dataloadgen.KeyedErrors[string]
+	if !errors.As(err, &errs) {
+		t.Fatalf("wrong error type: %T", err)
+	}
+	if len(errs.Failed()) != 2 || len(errs.NotFound()) != 2 || !errs.Only(dataloadgen.ErrNotFound) {
+		t.Fatal("wrong errors", errs)
+	}
+	if !errors.Is(err, dataloadgen.ErrNotFound) {
+		t.Fatal("error does not unwrap", err)
+	}
+
+	_, err = dl.LoadAll(ctx, []string{"1", "2", "bad"})
+	errors.As(err, &errs)
+	if len(errs.Failed()) != 2 || len(errs.NotFound()) != 1 || errs.Only(dataloadgen.ErrNotFound) {
+		t.Fatal("wrong errors", errs)
+	}
+	if err.Error() != "Keyed errors: [2: dataloadgen: not found, bad: bad key]" {
+		t.Fatal("wrong error message", err)
+	}
+
+	errs = dataloadgen.KeyedErrors[string]{"c": errors.New("c"), "a": errors.New("a"), "b": errors.New("b")}
+	for i := 0; i < 20; i++ {
+		if errs.Error() != "Keyed errors: [a: a, b: b, c: c]" {
+			t.Fatal("wrong error message", errs.Error())
+		}
+	}
+}
+
+func TestFetchContractError(t *testing.T) {
+	ctx := context.Background()
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		return []string{"1"}, nil
+	})
+	_, err := dl.LoadAll(ctx, []int{1, 2})
+	var contractErr *dataloadgen.FetchContractError
+	if !errors.As(err, &contractErr) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if contractErr.Violation != dataloadgen.WrongValueCount || contractErr.Keys != 2 || contractErr.Returned != 1 {
+		t.Fatalf("wrong error: %#v", contractErr)
+	}
+
+	dl = dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		return []string{"1", "2", "3"}, []error{nil, context.Canceled}
+	})
+	_, err = dl.LoadAll(ctx, []int{1, 2, 3})
+	if !errors.As(err, &contractErr) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if contractErr.Violation != dataloadgen.WrongErrorCount || contractErr.Keys != 3 || contractErr.Returned != 2 {
+		t.Fatalf("wrong error: %#v", contractErr)
+	}
+	if !errors.Is(contractErr, context.Canceled) {
+		t.Fatal("error does not unwrap the last error")
+	}
+}
+
+func TestPanicOnContractViolation(t *testing.T) {
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		return nil, nil
+	},
+		dataloadgen.WithPanicOnContractViolation(),
+	)
+	defer func() {
+		if _, ok := recover().(*dataloadgen.FetchContractError); !ok {
+			t.Fatal("expected panic with a FetchContractError")
+		}
+	}()
+	dl.Load(context.Background(), 1)
+}
+
+func TestPanicError(t *testing.T) {
+	ctx := context.Background()
+	fetchErr := errors.New("fetch error")
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		panic(fetchErr)
+	})
+	_, err := dl.Load(ctx, 1)
+	var panicErr *dataloadgen.PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if panicErr.Value != fetchErr || !errors.Is(err, fetchErr) {
+		t.Fatalf("wrong panic value: %v", panicErr.Value)
+	}
+	if !strings.Contains(string(panicErr.Stack), "TestPanicError") {
+		t.Fatalf("stack doesn't contain the fetch function: %s", panicErr.Stack)
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		panic("fetch panic")
+	},
+		dataloadgen.WithPanicHandler(func(ctx context.Context, err *dataloadgen.PanicError) {
+			panic(err.Value)
+		}),
+	)
+	defer func() {
+		if recover() != "fetch panic" {
+			t.Fatal("expected panic on the calling goroutine")
+		}
+	}()
+	dl.Load(context.Background(), 1)
+}
+
+func TestPanicNotCached(t *testing.T) {
+	var fetches, handled int
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]int, []error) {
+		fetches++
+		if fetches == 1 {
+			panic("fetch panic")
+		}
+		return keys, nil
+	},
+		dataloadgen.WithPanicHandler(func(ctx context.Context, err *dataloadgen.PanicError) {
+			handled++
+		}),
+	)
+	ctx := context.Background()
+	var panicErr *dataloadgen.PanicError
+	if _, err := dl.Load(ctx, 1); !errors.As(err, &panicErr) {
+		t.Fatal("expected a PanicError", err)
+	}
+	if v, err := dl.Load(ctx, 1); err != nil || v != 1 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	if fetches != 2 || handled != 1 {
+		t.Fatal("panic was cached", fetches, handled)
+	}
+}
+
+func TestStrictMappedFetch(t *testing.T) {
+	ctx := context.Background()
+	var unexpected []string
+	dl := dataloadgen.NewMappedLoader(func(_ context.Context, keys []string) (map[string]int, error) {
+		return map[string]int{"a": 1, "b": 2}, dataloadgen.MappedFetchError[string]{"C": dataloadgen.ErrNotFound}
+	},
+		dataloadgen.WithStrictMappedFetch(func(_ context.Context, keys []string) {
+			unexpected = append(unexpected, keys...)
+		}),
+	)
+
+	values, errs := dl.LoadMap(ctx, []string{"a", "B", "C"})
+	if len(values) != 1 || values["a"] != 1 {
+		t.Fatal("wrong values", values)
+	}
+	if !errors.Is(errs["C"], dataloadgen.ErrNotFound) {
+		t.Fatal("wrong error for explicitly not found key", errs["C"])
+	}
+	var missingErr *dataloadgen.MissingKeyError[string]
+	if !errors.As(errs["B"], &missingErr) || errors.Is(errs["B"], dataloadgen.ErrNotFound) {
+		t.Fatal("wrong error for missing key", errs["B"])
+	}
+	if missingErr.Key != "B" || len(missingErr.Unexpected) != 1 || missingErr.Unexpected[0] != "b" {
+		t.Fatalf("wrong error: %#v", missingErr)
+	}
+	if len(unexpected) != 1 || unexpected[0] != "b" {
+		t.Fatal("wrong unexpected keys reported", unexpected)
+	}
+}
+
+func TestMissingKeyPolicies(t *testing.T) {
+	ctx := context.Background()
+	fetch := func(_ context.Context, keys []string) (map[string]int, error) {
+		return map[string]int{"1": 1}, nil
+	}
+
+	v, err := dataloadgen.NewMappedLoader(fetch, dataloadgen.WithMissingZero()).Load(ctx, "2")
+	if v != 0 || err != nil {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+
+	v, err = dataloadgen.NewMappedLoader(fetch, dataloadgen.WithMissingDefault(func(key string) int {
+		return -1
+	})).Load(ctx, "2")
+	if v != -1 || err != nil {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+
+	_, err = dataloadgen.NewMappedLoader(fetch, dataloadgen.WithMissingError(func(key string) error {
+		return fmt.Errorf("no number %s", key)
+	})).Load(ctx, "2")
+	if err == nil || err.Error() != "no number 2" {
+		t.Fatalf("wrong err: %v", err)
+	}
+
+	v, err = dataloadgen.NewMappedLoader(fetch, dataloadgen.WithMissingZero()).Load(ctx, "1")
+	if v != 1 || err != nil {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+}
+
+func TestMissingKeyPolicyWrongTypes(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	dataloadgen.NewMappedLoader(func(_ context.Context, keys []string) (map[string]int, error) {
+		return nil, nil
+	},
+		dataloadgen.WithMissingDefault(func(key int) int { return key }),
+	)
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	ctx := context.Background()
+	var fetches [][]string
+	var mu sync.Mutex
+	dl := dataloadgen.NewMappedLoader(func(_ context.Context, emails []string) (map[string]int, error) {
+		mu.Lock()
+		fetches = append(fetches, emails)
+		mu.Unlock()
+		// the database returns emails the way they were stored
+		return map[string]int{"A@example.com": 1, "b@example.com": 2}, nil
+	},
+		dataloadgen.WithKeyNormalizer(strings.ToLower),
+	)
+
+	values, err := dl.LoadAll(ctx, []string{"a@example.com", "A@Example.com", "B@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != "[1 1 2]" {
+		t.Fatal("wrong values", values)
+	}
+	mu.Lock()
+	if len(fetches) != 1 || fmt.Sprint(fetches[0]) != "[a@example.com b@example.com]" {
+		t.Fatal("keys not normalized", fetches)
+	}
+	mu.Unlock()
+
+	dl.Clear("B@EXAMPLE.COM")
+	if !dl.Prime("B@Example.com", 3) {
+		t.Fatal("key not cleared")
+	}
+	if v, err := dl.Load(ctx, "b@example.com"); err != nil || v != 3 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	var fetched []int
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		fetched = keys
+		results := make([]string, len(keys))
+		for i, key := range keys {
+			results[i] = fmt.Sprint(key)
+		}
+		return results, nil
+	},
+		dataloadgen.WithKeyOrder(func(a, b int) bool { return a < b }),
+	)
+
+	values, err := dl.LoadAll(context.Background(), []int{3, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(fetched) != "[1 2 3]" {
+		t.Fatal("keys not sorted", fetched)
+	}
+	if fmt.Sprint(values) != "[3 1 2]" {
+		t.Fatal("values not returned in the order of the keys", values)
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		<-release
+		results := make([]string, len(keys))
+		for i, key := range keys {
+			results[i] = fmt.Sprint("fetched ", key)
+		}
+		return results, nil
+	},
+		dataloadgen.WithWait(time.Millisecond),
+	)
+
+	thunk := dl.LoadThunk(ctx, 1)
+	time.Sleep(5 * time.Millisecond)
+	// the fetch for key 1 is in flight
+	dl.Set(1, "set 1")
+	if v, err := thunk(); err != nil || v != "set 1" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	close(release)
+	time.Sleep(5 * time.Millisecond)
+	if v, err := dl.Load(ctx, 1); err != nil || v != "set 1" {
+		t.Fatalf("fetch result replaced the set value: %v %v", v, err)
+	}
+
+	if v, err := dl.Load(ctx, 2); err != nil || v != "fetched 2" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	dl.Set(2, "set 2")
+	if v, err := dl.Load(ctx, 2); err != nil || v != "set 2" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+}
+
+func TestSetDuringOnResult(t *testing.T) {
+	ctx := context.Background()
+	inHook := make(chan struct{})
+	setDone := make(chan struct{})
+	var once sync.Once
+	hooked := make(chan string, 2)
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		results := make([]string, len(keys))
+		for i, key := range keys {
+			results[i] = fmt.Sprint("fetched ", key)
+		}
+		return results, nil
+	},
+		dataloadgen.WithMeterProvider(noop.NewMeterProvider()),
+		dataloadgen.WithKeyOrder(func(a, b int) bool { return a < b }),
+		dataloadgen.WithOnResult(func(key int, value string) {
+			once.Do(func() {
+				close(inHook)
+				// the other results are still being handed out while the keys are Set
+				<-setDone
+			})
+			hooked <- value
+		}),
+	)
+
+	thunks := []func() (string, error){dl.LoadThunk(ctx, 1), dl.LoadThunk(ctx, 2)}
+	<-inHook
+	dl.Set(1, "set")
+	dl.Set(2, "set")
+	close(setDone)
+	for _, thunk := range thunks {
+		if v, err := thunk(); err != nil || v != "set" {
+			t.Fatalf("wrong value/err: %v %v", v, err)
+		}
+	}
+	// the hook gets the values that were loaded, even for keys that were Set in the meantime
+	for _, want := range []string{"fetched 1", "fetched 2"} {
+		select {
+		case v := <-hooked:
+			if v != want {
+				t.Fatal("wrong value passed to the hook", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("hook not called with", want)
+		}
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	var fetches int
+	dl := dataloadgen.NewLoader(func(_ context.Context, keys []int) ([]string, []error) {
+		fetches++
+		return make([]string, len(keys)), nil
+	})
+
+	v, err := dl.WriteThrough(ctx, 1, func(ctx context.Context) (string, error) {
+		return "written", nil
+	})
+	if err != nil || v != "written" {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	_, err = dl.WriteThrough(ctx, 2, func(ctx context.Context) (string, error) {
+		return "", errors.New("write failed")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if v, err := dl.Load(ctx, 1); err != nil || v != "written" || fetches != 0 {
+		t.Fatalf("written value not cached: %v %v", v, err)
+	}
+	if _, err := dl.Load(ctx, 2); err != nil || fetches != 1 {
+		t.Fatal("failed write was cached")
+	}
+}
+
+func TestNegativeCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	var fetches int
+	var mu sync.Mutex
+	dl := dataloadgen.NewMappedLoader(func(_ context.Context, keys []int) (map[int]int, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		return map[int]int{1: 1}, nil
+	},
+		dataloadgen.WithWait(time.Millisecond),
+		dataloadgen.WithNegativeCacheTTL(20*time.Millisecond),
+	)
+
+	dl.LoadAll(ctx, []int{1, 2})
+	dl.LoadAll(ctx, []int{1, 2})
+	mu.Lock()
+	if fetches != 1 {
+		t.Fatal("not found result not cached", fetches)
+	}
+	mu.Unlock()
+	stats := dl.Stats()
+	if stats.Misses != 2 || stats.Hits != 1 || stats.NegativeHits != 1 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := dl.Load(ctx, 2); !errors.Is(err, dataloadgen.ErrNotFound) {
+		t.Fatal("wrong error", err)
+	}
+	if _, err := dl.Load(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Fatal("not found result didn't expire or found result expired", fetches)
+	}
+	stats = dl.Stats()
+	if stats.Misses != 3 || stats.Hits != 2 || stats.NegativeHits != 1 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+
+	// expired results don't count as cached
+	time.Sleep(30 * time.Millisecond)
+	if !dl.Prime(2, 5) {
+		t.Fatal("expired result prevented prime")
+	}
+	if v, err := dl.Load(ctx, 2); err != nil || v != 5 {
+		t.Fatalf("wrong value/err: %v %v", v, err)
+	}
+	if fetches != 2 {
+		t.Fatal("primed value was fetched", fetches)
+	}
+}
+
+func TestFetchMiddleware(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var calls []string
+	logging := func(name string) func(next dataloadgen.FetchFunc[string, int]) dataloadgen.FetchFunc[string, int] {
+		return func(next dataloadgen.FetchFunc[string, int]) dataloadgen.FetchFunc[string, int] {
+			return func(ctx context.Context, keys []string) ([]int, []error) {
+				mu.Lock()
+				calls = append(calls, name+" before")
+				mu.Unlock()
+				values, errs := next(ctx, keys)
+				mu.Lock()
+				calls = append(calls, name+" after")
+				mu.Unlock()
+				return values, errs
+			}
+		}
+	}
+	retry := func(next dataloadgen.FetchFunc[string, int]) dataloadgen.FetchFunc[string, int] {
+		return func(ctx context.Context, keys []string) ([]int, []error) {
+			values, errs := next(ctx, keys)
+			if len(errs) == 1 && errs[0] != nil {
+				return next(ctx, keys)
+			}
+			return values, errs
+		}
+	}
+	options := []dataloadgen.Option{
+		dataloadgen.WithFetchMiddleware(logging("outer")),
+		dataloadgen.WithFetchMiddleware(logging("inner")),
+		dataloadgen.WithFetchMiddleware(retry),
+	}
+
+	var attempts int
+	loader := dataloadgen.NewLoader(func(_ context.Context, keys []string) ([]int, []error) {
+		attempts++
+		if attempts == 1 {
+			return nil, []error{errors.New("transient")}
+		}
+		return make([]int, len(keys)), nil
+	}, options...)
+	if _, err := loader.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatal("fetch not retried", attempts)
+	}
+	if strings.Join(calls, ", ") != "outer before, inner before, inner after, outer after" {
+		t.Fatal("wrong middleware order", calls)
+	}
+
+	calls = nil
+	mapped := dataloadgen.NewMappedLoader(func(_ context.Context, keys []string) (map[string]int, error) {
+		return map[string]int{"a": 1}, nil
+	}, options...)
+	if v, err := mapped.Load(ctx, "a"); err != nil || v != 1 {
+		t.Fatal("wrong result", v, err)
+	}
+	if len(calls) != 4 {
+		t.Fatal("middleware not applied to mapped loader", calls)
+	}
+
+	panicking := dataloadgen.NewLoader(func(_ context.Context, keys []string) ([]int, []error) {
+		return make([]int, len(keys)), nil
+	}, dataloadgen.WithFetchMiddleware(func(next dataloadgen.FetchFunc[string, int]) dataloadgen.FetchFunc[string, int] {
+		return func(ctx context.Context, keys []string) ([]int, []error) {
+			panic("middleware panic")
+		}
+	}))
+	var panicErr *dataloadgen.PanicError
+	if _, err := panicking.Load(ctx, "a"); !errors.As(err, &panicErr) || panicErr.Value != "middleware panic" {
+		t.Fatal("middleware panic not recovered", err)
+	}
+}
@@ -2,6 +2,16 @@ module github.com/vikstrous/dataloadgen
 
 go 1.20
 
-require go.opentelemetry.io/otel/trace v1.11.1
+require (
+	go.opentelemetry.io/otel v1.19.0
+	go.opentelemetry.io/otel/metric v1.19.0
+	go.opentelemetry.io/otel/sdk/metric v1.19.0
+	go.opentelemetry.io/otel/trace v1.19.0
+)
 
-require go.opentelemetry.io/otel v1.11.1 // indirect
+require (
+	github.com/go-logr/logr v1.2.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/sdk v1.19.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
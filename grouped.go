@@ -0,0 +1,77 @@
+package dataloadgen
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// WithGroupLimit limits the number of values per key of loaders created by NewGroupedLoader.
+// Default is 0 (unlimited).
+func WithGroupLimit(n int) Option {
+	return func(l *loaderConfig) {
+		l.groupLimit = n
+	}
+}
+
+// WithGroupOrder sorts the values of each key of loaders created by NewGroupedLoader. The sort is
+// stable and happens before WithGroupLimit is applied. ValueT must match the values of the fetch function.
+func WithGroupOrder[ValueT any](less func(a, b ValueT) bool) Option {
+	return func(l *loaderConfig) {
+		l.groupLess = less
+	}
+}
+
+// NewGroupedLoader creates a loader for one-to-many relationships, like comments by post ID.
+// fetch returns the values for all of the keys in any order, and keyOf returns the key each value
+// belongs to, which is normalized if the loader uses WithKeyNormalizer. Every key gets a slice of
+// its values, which is empty if there are none. An error returned by fetch is returned for every key.
+func NewGroupedLoader[KeyT comparable, ValueT any](fetch func(ctx context.Context, keys []KeyT) ([]ValueT, error), keyOf func(ValueT) KeyT, options ...Option) *Loader[KeyT, []ValueT] {
+	l := NewLoader[KeyT, []ValueT](nil, options...)
+	var less func(a, b ValueT) bool
+	if l.groupLess != nil {
+		var ok bool
+		less, ok = l.groupLess.(func(a, b ValueT) bool)
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithGroupOrder was given a %T for a loader with %T values", l.groupLess, *new(ValueT)))
+		}
+	}
+	if normalize := l.normalize; normalize != nil {
+		rawKeyOf := keyOf
+		keyOf = func(value ValueT) KeyT { return normalize(rawKeyOf(value)) }
+	}
+	l.fetch = l.wrapFetch(convertGroupedFetch(fetch, keyOf, less, l.groupLimit))
+	return l
+}
+
+// convertGroupedFetch accepts a fetcher method that returns a flat list of values, and converts it to a fetcher that returns the values grouped by key.
+func convertGroupedFetch[KeyT comparable, ValueT any](fetch func(ctx context.Context, keys []KeyT) ([]ValueT, error), keyOf func(ValueT) KeyT, less func(a, b ValueT) bool, limit int) func(ctx context.Context, keys []KeyT) ([][]ValueT, []error) {
+	return func(ctx context.Context, keys []KeyT) ([][]ValueT, []error) {
+		values, err := fetch(ctx, keys)
+		if err != nil {
+			return nil, []error{err}
+		}
+
+		groups := make(map[KeyT][]ValueT, len(keys))
+		for _, value := range values {
+			key := keyOf(value)
+			groups[key] = append(groups[key], value)
+		}
+
+		results := make([][]ValueT, len(keys))
+		for i, key := range keys {
+			group := groups[key]
+			if group == nil {
+				group = []ValueT{}
+			}
+			if less != nil {
+				sort.SliceStable(group, func(i, j int) bool { return less(group[i], group[j]) })
+			}
+			if limit > 0 && len(group) > limit {
+				group = group[:limit]
+			}
+			results[i] = group
+		}
+		return results, nil
+	}
+}
@@ -0,0 +1,71 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+type comment struct {
+	PostID int
+	ID     int
+}
+
+func TestGroupedLoader(t *testing.T) {
+	ctx := context.Background()
+	comments := []comment{{1, 3}, {2, 1}, {1, 1}, {1, 2}, {3, 1}}
+	dl := dataloadgen.NewGroupedLoader(func(_ context.Context, postIDs []int) ([]comment, error) {
+		return comments, nil
+	}, func(c comment) int {
+		return c.PostID
+	})
+
+	groups, err := dl.LoadAll(ctx, []int{1, 2, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[[{1 3} {1 1} {1 2}] [{2 1}] []]" {
+		t.Fatal("wrong groups", groups)
+	}
+	if groups[2] == nil {
+		t.Fatal("expected an empty slice for a key without values")
+	}
+}
+
+func TestGroupedLoaderOrderAndLimit(t *testing.T) {
+	ctx := context.Background()
+	comments := []comment{{1, 3}, {2, 1}, {1, 1}, {1, 2}}
+	dl := dataloadgen.NewGroupedLoader(func(_ context.Context, postIDs []int) ([]comment, error) {
+		return comments, nil
+	}, func(c comment) int {
+		return c.PostID
+	},
+		dataloadgen.WithGroupOrder(func(a, b comment) bool { return a.ID < b.ID }),
+		dataloadgen.WithGroupLimit(2),
+	)
+
+	group, err := dl.Load(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(group) != "[{1 1} {1 2}]" {
+		t.Fatal("wrong group", group)
+	}
+}
+
+func TestGroupedLoaderError(t *testing.T) {
+	fetchErr := errors.New("fetch failed")
+	dl := dataloadgen.NewGroupedLoader(func(_ context.Context, postIDs []int) ([]comment, error) {
+		return nil, fetchErr
+	}, func(c comment) int {
+		return c.PostID
+	})
+
+	_, err := dl.LoadAll(context.Background(), []int{1, 2})
+	if !errors.Is(err, fetchErr) {
+		t.Fatal("wrong error", err)
+	}
+}
@@ -0,0 +1,131 @@
+package dataloadgen
+
+import (
+	"context"
+	"sync"
+)
+
+// HashedLoader batches and caches requests for keys of any type, including ones that aren't
+// comparable like slices, maps and structs containing them. Keys are deduplicated and cached by the
+// canonical ID of each key, while the fetch function still receives the original keys.
+type HashedLoader[KeyT any, IDT comparable, ValueT any] struct {
+	loader *Loader[IDT, ValueT]
+	id     func(KeyT) IDT
+
+	// the key that was first loaded for each ID that is being loaded. Keys are removed once nothing
+	// is waiting for them to be fetched.
+	keys map[IDT]*hashedKey[KeyT]
+	mu   sync.Mutex
+}
+
+type hashedKey[KeyT any] struct {
+	key KeyT
+	// the number of loads adding the key to the loader and of entries waiting for it to be fetched
+	refs int
+}
+
+// NewHashedLoader creates a new HashedLoader given a fetch function and a function that returns the
+// canonical ID of a key. Keys with the same ID must load the same value.
+func NewHashedLoader[KeyT any, IDT comparable, ValueT any](fetch func(ctx context.Context, keys []KeyT) ([]ValueT, []error), id func(KeyT) IDT, options ...Option) *HashedLoader[KeyT, IDT, ValueT] {
+	h := &HashedLoader[KeyT, IDT, ValueT]{
+		id:   id,
+		keys: map[IDT]*hashedKey[KeyT]{},
+	}
+	h.loader = NewLoader(func(ctx context.Context, ids []IDT) ([]ValueT, []error) {
+		keys := make([]KeyT, len(ids))
+		h.mu.Lock()
+		for i, id := range ids {
+			keys[i] = h.keys[id].key
+			h.release(id)
+		}
+		h.mu.Unlock()
+		return fetch(ctx, keys)
+	}, options...)
+	// the loader holds a reference to the key of each entry until it's fetched
+	h.loader.onEnqueue = func(id IDT) {
+		h.mu.Lock()
+		h.keys[id].refs++
+		h.mu.Unlock()
+	}
+	h.loader.onDrop = func(id IDT) {
+		h.mu.Lock()
+		h.release(id)
+		h.mu.Unlock()
+	}
+	return h
+}
+
+// acquire returns the IDs of keys and remembers the keys until release is called for each ID, so
+// that the loader can add them to batches
+func (h *HashedLoader[KeyT, IDT, ValueT]) acquire(keys ...KeyT) []IDT {
+	ids := make([]IDT, len(keys))
+	h.mu.Lock()
+	for i, key := range keys {
+		ids[i] = h.id(key)
+		k, ok := h.keys[ids[i]]
+		if !ok {
+			k = &hashedKey[KeyT]{key: key}
+			h.keys[ids[i]] = k
+		}
+		k.refs++
+	}
+	h.mu.Unlock()
+	return ids
+}
+
+// releaseAll releases the IDs returned by acquire
+func (h *HashedLoader[KeyT, IDT, ValueT]) releaseAll(ids []IDT) {
+	h.mu.Lock()
+	for _, id := range ids {
+		h.release(id)
+	}
+	h.mu.Unlock()
+}
+
+// release drops a reference to the key of id. It must be called with the mutex held.
+func (h *HashedLoader[KeyT, IDT, ValueT]) release(id IDT) {
+	k := h.keys[id]
+	k.refs--
+	if k.refs == 0 {
+		delete(h.keys, id)
+	}
+}
+
+// Load a ValueT by key, batching and caching will be applied automatically
+func (h *HashedLoader[KeyT, IDT, ValueT]) Load(ctx context.Context, key KeyT) (ValueT, error) {
+	return h.LoadThunk(ctx, key)()
+}
+
+// LoadThunk returns a function that when called will block waiting for a ValueT, see Loader.LoadThunk
+func (h *HashedLoader[KeyT, IDT, ValueT]) LoadThunk(ctx context.Context, key KeyT) func() (ValueT, error) {
+	ids := h.acquire(key)
+	defer h.releaseAll(ids)
+	return h.loader.LoadThunk(ctx, ids[0])
+}
+
+// LoadAll fetches many keys at once, see Loader.LoadAll. Errors are keyed by ID.
+func (h *HashedLoader[KeyT, IDT, ValueT]) LoadAll(ctx context.Context, keys []KeyT) ([]ValueT, error) {
+	return h.LoadAllThunk(ctx, keys)()
+}
+
+// LoadAllThunk returns a function that when called will block waiting for the ValueTs, see Loader.LoadAllThunk
+func (h *HashedLoader[KeyT, IDT, ValueT]) LoadAllThunk(ctx context.Context, keys []KeyT) func() ([]ValueT, error) {
+	ids := h.acquire(keys...)
+	defer h.releaseAll(ids)
+	return h.loader.LoadAllThunk(ctx, ids)
+}
+
+// Prime the cache with the provided key and value, see Loader.Prime
+func (h *HashedLoader[KeyT, IDT, ValueT]) Prime(key KeyT, value ValueT) bool {
+	return h.loader.Prime(h.id(key), value)
+}
+
+// Clear the value at key from the cache, if it exists
+func (h *HashedLoader[KeyT, IDT, ValueT]) Clear(key KeyT) {
+	h.loader.Clear(h.id(key))
+}
+
+// ClearAll clears all values from the cache
+func (h *HashedLoader[KeyT, IDT, ValueT]) ClearAll() {
+	h.loader.ClearAll()
+}
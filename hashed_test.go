@@ -0,0 +1,107 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+type filter struct {
+	Tags []string
+}
+
+func TestHashedLoader(t *testing.T) {
+	ctx := context.Background()
+	var fetches [][]filter
+	var mu sync.Mutex
+	dl := dataloadgen.NewHashedLoader(func(_ context.Context, filters []filter) ([]int, []error) {
+		mu.Lock()
+		fetches = append(fetches, filters)
+		mu.Unlock()
+		counts := make([]int, len(filters))
+		for i, f := range filters {
+			counts[i] = len(f.Tags)
+		}
+		return counts, nil
+	}, func(f filter) string {
+		return strings.Join(f.Tags, ",")
+	})
+
+	counts, err := dl.LoadAll(ctx, []filter{{[]string{"a", "b"}}, {[]string{"a"}}, {[]string{"a", "b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(counts) != "[2 1 2]" {
+		t.Fatal("wrong values", counts)
+	}
+	count, err := dl.Load(ctx, filter{[]string{"a"}})
+	if err != nil || count != 1 {
+		t.Fatalf("wrong value/err: %v %v", count, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetches) != 1 || len(fetches[0]) != 2 {
+		t.Fatal("keys not deduplicated by ID", fetches)
+	}
+	if fmt.Sprint(fetches[0]) != "[{[a b]} {[a]}]" {
+		t.Fatal("fetch didn't receive the original keys", fetches)
+	}
+}
+
+func TestHashedLoaderClear(t *testing.T) {
+	ctx := context.Background()
+	var fetches []string
+	var mu sync.Mutex
+	dl := dataloadgen.NewHashedLoader(func(_ context.Context, filters []filter) ([]int, []error) {
+		mu.Lock()
+		fetches = append(fetches, fmt.Sprint(filters))
+		mu.Unlock()
+		return make([]int, len(filters)), nil
+	}, func(f filter) string {
+		tags := append([]string{}, f.Tags...)
+		sort.Strings(tags)
+		return strings.Join(tags, ",")
+	}, dataloadgen.WithWait(20*time.Millisecond))
+
+	// keys that are being loaded are still fetched after they're cleared
+	thunk := dl.LoadThunk(ctx, filter{[]string{"b", "a"}})
+	dl.Clear(filter{[]string{"a", "b"}})
+	thunk2 := dl.LoadThunk(ctx, filter{[]string{"c"}})
+	dl.ClearAll()
+	if _, err := thunk(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := thunk2(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys are only remembered until they're fetched, so the next key with the same ID is the one that's fetched
+	dl.Clear(filter{[]string{"a", "b"}})
+	thunk = dl.LoadThunk(ctx, filter{[]string{"a", "b"}})
+	if _, err := thunk(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys of loads that were cancelled before being fetched aren't remembered either
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := dl.Load(cancelled, filter{[]string{"d", "e"}}); err != context.Canceled {
+		t.Fatal("expected context.Canceled", err)
+	}
+	if _, err := dl.Load(ctx, filter{[]string{"e", "d"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(fetches, " ") != "[{[b a]} {[c]}] [{[a b]}] [{[e d]}]" {
+		t.Fatal("wrong fetches", fetches)
+	}
+}
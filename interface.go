@@ -0,0 +1,114 @@
+package dataloadgen
+
+import (
+	"context"
+	"sync"
+)
+
+// Interface is implemented by Loader. Code that depends on it instead of *Loader can be tested with
+// a fake like StaticLoader or have its loaders wrapped with extra behavior.
+type Interface[KeyT comparable, ValueT any] interface {
+	Load(ctx context.Context, key KeyT) (ValueT, error)
+	LoadThunk(ctx context.Context, key KeyT) func() (ValueT, error)
+	LoadAll(ctx context.Context, keys []KeyT) ([]ValueT, error)
+	LoadAllThunk(ctx context.Context, keys []KeyT) func() ([]ValueT, error)
+	Prime(key KeyT, value ValueT) bool
+	Clear(key KeyT)
+	ClearAll()
+}
+
+var _ Interface[string, string] = (*Loader[string, string])(nil)
+
+// StaticLoader implements Interface with fixed values and errors, for use as a fake in tests.
+// Keys with neither a value nor an error fail with ErrNotFound.
+type StaticLoader[KeyT comparable, ValueT any] struct {
+	values map[KeyT]ValueT
+	errs   map[KeyT]error
+	mu     sync.Mutex
+}
+
+var _ Interface[string, string] = (*StaticLoader[string, string])(nil)
+
+// NewStaticLoader creates a StaticLoader that returns the given values and errors. The maps are copied.
+func NewStaticLoader[KeyT comparable, ValueT any](values map[KeyT]ValueT, errs map[KeyT]error) *StaticLoader[KeyT, ValueT] {
+	s := &StaticLoader[KeyT, ValueT]{
+		values: make(map[KeyT]ValueT, len(values)),
+		errs:   make(map[KeyT]error, len(errs)),
+	}
+	for key, value := range values {
+		s.values[key] = value
+	}
+	for key, err := range errs {
+		s.errs[key] = err
+	}
+	return s
+}
+
+// Load returns the value or error for key
+func (s *StaticLoader[KeyT, ValueT]) Load(ctx context.Context, key KeyT) (ValueT, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err, ok := s.errs[key]; ok {
+		var zero ValueT
+		return zero, err
+	}
+	if value, ok := s.values[key]; ok {
+		return value, nil
+	}
+	var zero ValueT
+	return zero, ErrNotFound
+}
+
+// LoadThunk returns a function that returns the value or error for key
+func (s *StaticLoader[KeyT, ValueT]) LoadThunk(ctx context.Context, key KeyT) func() (ValueT, error) {
+	value, err := s.Load(ctx, key)
+	return func() (ValueT, error) {
+		return value, err
+	}
+}
+
+// LoadAll returns the values for keys, and KeyedErrors if any of them failed
+func (s *StaticLoader[KeyT, ValueT]) LoadAll(ctx context.Context, keys []KeyT) ([]ValueT, error) {
+	thunks := make([]func() (ValueT, error), len(keys))
+	for i, key := range keys {
+		thunks[i] = s.LoadThunk(ctx, key)
+	}
+	return waitAll(keys, thunks)
+}
+
+// LoadAllThunk returns a function that returns the result of LoadAll
+func (s *StaticLoader[KeyT, ValueT]) LoadAllThunk(ctx context.Context, keys []KeyT) func() ([]ValueT, error) {
+	values, err := s.LoadAll(ctx, keys)
+	return func() ([]ValueT, error) {
+		return values, err
+	}
+}
+
+// Prime sets the value for key if it has neither a value nor an error, and reports whether it did
+func (s *StaticLoader[KeyT, ValueT]) Prime(key KeyT, value ValueT) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, hasValue := s.values[key]
+	_, hasErr := s.errs[key]
+	if hasValue || hasErr {
+		return false
+	}
+	s.values[key] = value
+	return true
+}
+
+// Clear removes the value or error for key
+func (s *StaticLoader[KeyT, ValueT]) Clear(key KeyT) {
+	s.mu.Lock()
+	delete(s.values, key)
+	delete(s.errs, key)
+	s.mu.Unlock()
+}
+
+// ClearAll removes all values and errors
+func (s *StaticLoader[KeyT, ValueT]) ClearAll() {
+	s.mu.Lock()
+	s.values = map[KeyT]ValueT{}
+	s.errs = map[KeyT]error{}
+	s.mu.Unlock()
+}
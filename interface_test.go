@@ -0,0 +1,58 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+// userName is an example of code that depends on dataloadgen.Interface so that it can be tested with a fake
+func userName(ctx context.Context, users dataloadgen.Interface[int, string], id int) string {
+	name, err := users.Load(ctx, id)
+	if errors.Is(err, dataloadgen.ErrNotFound) {
+		return "unknown"
+	}
+	if err != nil {
+		return "error"
+	}
+	return name
+}
+
+func TestStaticLoader(t *testing.T) {
+	ctx := context.Background()
+	users := dataloadgen.NewStaticLoader(map[int]string{1: "alice"}, map[int]error{2: errors.New("boom")})
+
+	if name := userName(ctx, users, 1); name != "alice" {
+		t.Fatal("wrong name", name)
+	}
+	if name := userName(ctx, users, 2); name != "error" {
+		t.Fatal("wrong name", name)
+	}
+	if name := userName(ctx, users, 3); name != "unknown" {
+		t.Fatal("wrong name", name)
+	}
+
+	names, err := users.LoadAllThunk(ctx, []int{1, 3})()
+	var errs dataloadgen.KeyedErrors[int]
+	if !errors.As(err, &errs) || len(errs) != 1 || !errors.Is(errs[3], dataloadgen.ErrNotFound) {
+		t.Fatal("wrong errors", err)
+	}
+	if fmt.Sprint(names) != "[alice ]" {
+		t.Fatal("wrong names", names)
+	}
+
+	if users.Prime(1, "bob") || !users.Prime(3, "carol") {
+		t.Fatal("wrong prime result")
+	}
+	users.Clear(2)
+	if name := userName(ctx, users, 2); name != "unknown" {
+		t.Fatal("wrong name", name)
+	}
+	users.ClearAll()
+	if name := userName(ctx, users, 1); name != "unknown" {
+		t.Fatal("wrong name", name)
+	}
+}
@@ -0,0 +1,80 @@
+package dataloadgen
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// WithMeterProvider records metrics about the loader's cache and batches with meters from provider:
+//
+//   - dataloadgen.batch.size: histogram of the number of keys passed to each fetch
+//   - dataloadgen.fetch.duration: histogram of how long each fetch took in seconds
+//   - dataloadgen.key.wait: histogram of the seconds between a key being added to a batch and its result being available
+//   - dataloadgen.cache.hits and dataloadgen.cache.misses: counters of loads that were and weren't served from the cache
+//   - dataloadgen.fetch.errors: counter of keys that failed to fetch
+//
+// Measurements have a dataloadgen.loader attribute if the loader is named with WithName.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(l *loaderConfig) {
+		l.meterProvider = provider
+	}
+}
+
+// WithName names the loader in its metrics
+func WithName(name string) Option {
+	return func(l *loaderConfig) {
+		l.name = name
+	}
+}
+
+const instrumentationName = "github.com/vikstrous/dataloadgen"
+
+// loaderMetrics holds the instruments that WithMeterProvider records to
+type loaderMetrics struct {
+	batchSize     metric.Int64Histogram
+	fetchDuration metric.Float64Histogram
+	keyWait       metric.Float64Histogram
+	cacheHits     metric.Int64Counter
+	cacheMisses   metric.Int64Counter
+	fetchErrors   metric.Int64Counter
+
+	// attrs is passed to every measurement
+	attrs metric.MeasurementOption
+}
+
+// newLoaderMetrics creates the instruments of a loader. If provider fails to create them, the
+// error is passed to the global OpenTelemetry error handler and nothing is recorded.
+func newLoaderMetrics(provider metric.MeterProvider, name string) *loaderMetrics {
+	m, err := createLoaderMetrics(provider.Meter(instrumentationName), name)
+	if err != nil {
+		otel.Handle(err)
+		m, _ = createLoaderMetrics(noop.NewMeterProvider().Meter(instrumentationName), name)
+	}
+	return m
+}
+
+func createLoaderMetrics(meter metric.Meter, name string) (*loaderMetrics, error) {
+	var attrs attribute.Set
+	if name != "" {
+		attrs = attribute.NewSet(attribute.String("dataloadgen.loader", name))
+	}
+	m := &loaderMetrics{attrs: metric.WithAttributeSet(attrs)}
+	var errs [6]error
+	m.batchSize, errs[0] = meter.Int64Histogram("dataloadgen.batch.size",
+		metric.WithDescription("Number of keys passed to each fetch"), metric.WithUnit("{key}"))
+	m.fetchDuration, errs[1] = meter.Float64Histogram("dataloadgen.fetch.duration",
+		metric.WithDescription("Duration of each fetch"), metric.WithUnit("s"))
+	m.keyWait, errs[2] = meter.Float64Histogram("dataloadgen.key.wait",
+		metric.WithDescription("Time between a key being added to a batch and its result being available"), metric.WithUnit("s"))
+	m.cacheHits, errs[3] = meter.Int64Counter("dataloadgen.cache.hits",
+		metric.WithDescription("Number of loads served from the cache"), metric.WithUnit("{load}"))
+	m.cacheMisses, errs[4] = meter.Int64Counter("dataloadgen.cache.misses",
+		metric.WithDescription("Number of loads that added a key to a batch"), metric.WithUnit("{load}"))
+	m.fetchErrors, errs[5] = meter.Int64Counter("dataloadgen.fetch.errors",
+		metric.WithDescription("Number of keys that failed to fetch"), metric.WithUnit("{key}"))
+	return m, errors.Join(errs[:]...)
+}
@@ -0,0 +1,81 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+func TestMeterProvider(t *testing.T) {
+	ctx := context.Background()
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	loader := dataloadgen.NewLoader(func(_ context.Context, keys []string) ([]int, []error) {
+		errs := make([]error, len(keys))
+		for i, key := range keys {
+			if key == "bad" {
+				errs[i] = errors.New("bad key")
+			}
+		}
+		return make([]int, len(keys)), errs
+	}, dataloadgen.WithMeterProvider(provider), dataloadgen.WithName("numbers"))
+
+	if _, err := loader.LoadAll(ctx, []string{"a", "b", "bad"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := loader.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]metricdata.Aggregation{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m.Data
+		}
+	}
+
+	name := attribute.String("dataloadgen.loader", "numbers")
+	for metric, want := range map[string]int64{
+		"dataloadgen.cache.hits":   1,
+		"dataloadgen.cache.misses": 3,
+		"dataloadgen.fetch.errors": 1,
+	} {
+		sum, ok := metrics[metric].(metricdata.Sum[int64])
+		if !ok || len(sum.DataPoints) != 1 {
+			t.Fatal("missing metric", metric)
+		}
+		if got := sum.DataPoints[0].Value; got != want {
+			t.Fatal("wrong value of", metric, got)
+		}
+		if !sum.DataPoints[0].Attributes.HasValue(name.Key) {
+			t.Fatal("missing loader name on", metric)
+		}
+	}
+
+	batchSize, ok := metrics["dataloadgen.batch.size"].(metricdata.Histogram[int64])
+	if !ok || len(batchSize.DataPoints) != 1 || batchSize.DataPoints[0].Count != 1 || batchSize.DataPoints[0].Sum != 3 {
+		t.Fatal("wrong batch size", metrics["dataloadgen.batch.size"])
+	}
+	if value, _ := batchSize.DataPoints[0].Attributes.Value(name.Key); value != name.Value {
+		t.Fatal("wrong loader name", value)
+	}
+	fetchDuration, ok := metrics["dataloadgen.fetch.duration"].(metricdata.Histogram[float64])
+	if !ok || len(fetchDuration.DataPoints) != 1 || fetchDuration.DataPoints[0].Count != 1 {
+		t.Fatal("wrong fetch duration", metrics["dataloadgen.fetch.duration"])
+	}
+	keyWait, ok := metrics["dataloadgen.key.wait"].(metricdata.Histogram[float64])
+	if !ok || len(keyWait.DataPoints) != 1 || keyWait.DataPoints[0].Count != 3 || keyWait.DataPoints[0].Sum <= 0 {
+		t.Fatal("wrong key wait", metrics["dataloadgen.key.wait"])
+	}
+}
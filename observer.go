@@ -0,0 +1,70 @@
+package dataloadgen
+
+import (
+	"context"
+	"time"
+)
+
+// Observer is notified of the events in the lifecycle of a loader's keys and batches, for logging,
+// metrics and debugging. Its methods are called synchronously, some of them while the loader is
+// locked, so they must not block or call the loader they observe. Embed NopObserver to only
+// implement some of them.
+type Observer[KeyT comparable] interface {
+	// KeyEnqueued is called when a key that isn't cached is added to a batch
+	KeyEnqueued(ctx context.Context, key KeyT)
+	// CacheHit is called when a key is found in the cache, whether it has been fetched yet or not
+	CacheHit(ctx context.Context, key KeyT)
+	// BatchCreated is called when a new batch is started, with the context of its first caller
+	BatchCreated(ctx context.Context)
+	// BatchDispatched is called when a batch stops accepting keys, with the context of its first
+	// caller and the number of keys that will be fetched
+	BatchDispatched(ctx context.Context, keys int, reason DispatchReason)
+	// FetchCompleted is called when the fetch function of a batch returns, with the context of the
+	// batch's first caller, the number of keys fetched and how many of them failed
+	FetchCompleted(ctx context.Context, keys int, duration time.Duration, errs int)
+	// KeyDelivered is called when a Load or a thunk returns, with the caller's context and error
+	KeyDelivered(ctx context.Context, key KeyT, err error)
+}
+
+// NopObserver implements every method of Observer by doing nothing
+type NopObserver[KeyT comparable] struct{}
+
+func (NopObserver[KeyT]) KeyEnqueued(ctx context.Context, key KeyT)                            {}
+func (NopObserver[KeyT]) CacheHit(ctx context.Context, key KeyT)                               {}
+func (NopObserver[KeyT]) BatchCreated(ctx context.Context)                                     {}
+func (NopObserver[KeyT]) BatchDispatched(ctx context.Context, keys int, reason DispatchReason) {}
+func (NopObserver[KeyT]) FetchCompleted(ctx context.Context, keys int, duration time.Duration, errs int) {
+}
+func (NopObserver[KeyT]) KeyDelivered(ctx context.Context, key KeyT, err error) {}
+
+// DispatchReason is why a batch stopped accepting keys
+type DispatchReason int
+
+const (
+	// DispatchTimeLimit means that the batch was open for the time set by WithWait
+	DispatchTimeLimit DispatchReason = iota
+	// DispatchKeyLimit means that the batch reached the size set by WithBatchCapacity
+	DispatchKeyLimit
+	// DispatchManual means that the batch was dispatched by Flush
+	DispatchManual
+)
+
+func (r DispatchReason) String() string {
+	switch r {
+	case DispatchTimeLimit:
+		return "timelimit"
+	case DispatchKeyLimit:
+		return "keylimit"
+	case DispatchManual:
+		return "manual"
+	}
+	return "unknown"
+}
+
+// WithObserver adds an observer that is notified of the events of the loader. KeyT must match the
+// key type of the loader.
+func WithObserver[KeyT comparable](observer Observer[KeyT]) Option {
+	return func(l *loaderConfig) {
+		l.observers = append(l.observers, observer)
+	}
+}
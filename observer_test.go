@@ -0,0 +1,104 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+type recordingObserver struct {
+	dataloadgen.NopObserver[string]
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	o.events = append(o.events, event)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) KeyEnqueued(_ context.Context, key string) { o.record("enqueued " + key) }
+func (o *recordingObserver) CacheHit(_ context.Context, key string)    { o.record("hit " + key) }
+func (o *recordingObserver) BatchCreated(_ context.Context)            { o.record("created") }
+func (o *recordingObserver) BatchDispatched(_ context.Context, keys int, reason dataloadgen.DispatchReason) {
+	o.record(fmt.Sprint("dispatched ", keys, " ", reason))
+}
+
+func (o *recordingObserver) FetchCompleted(_ context.Context, keys int, _ time.Duration, errs int) {
+	o.record(fmt.Sprint("fetched ", keys, " ", errs))
+}
+
+func (o *recordingObserver) KeyDelivered(_ context.Context, key string, err error) {
+	o.record(fmt.Sprint("delivered ", key, " ", err))
+}
+
+func (o *recordingObserver) take() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	events := strings.Join(o.events, ", ")
+	o.events = nil
+	return events
+}
+
+func TestObserver(t *testing.T) {
+	ctx := context.Background()
+	observer := &recordingObserver{}
+	loader := dataloadgen.NewLoader(func(_ context.Context, keys []string) ([]int, []error) {
+		errs := make([]error, len(keys))
+		for i, key := range keys {
+			if key == "bad" {
+				errs[i] = errors.New("bad key")
+			}
+		}
+		return make([]int, len(keys)), errs
+	}, dataloadgen.WithBatchCapacity(2), dataloadgen.WithWait(time.Hour), dataloadgen.WithObserver[string](observer))
+
+	if _, err := loader.LoadAll(ctx, []string{"a", "bad"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if events := observer.take(); events != "created, enqueued a, enqueued bad, dispatched 2 keylimit, fetched 2 1, delivered a <nil>, delivered bad bad key" {
+		t.Fatal("wrong events:", events)
+	}
+
+	if _, err := loader.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if events := observer.take(); events != "hit a, delivered a <nil>" {
+		t.Fatal("wrong events:", events)
+	}
+
+	thunk := loader.LoadThunk(ctx, "c")
+	loader.Flush()
+	if _, err := thunk(); err != nil {
+		t.Fatal(err)
+	}
+	if events := observer.take(); events != "created, enqueued c, dispatched 1 manual, fetched 1 0, delivered c <nil>" {
+		t.Fatal("wrong events:", events)
+	}
+}
+
+func TestObserverTimeLimit(t *testing.T) {
+	observer := &recordingObserver{}
+	loader := dataloadgen.NewLoader(func(_ context.Context, keys []string) ([]int, []error) {
+		return make([]int, len(keys)), nil
+	}, dataloadgen.WithWait(time.Millisecond), dataloadgen.WithObserver[string](observer))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := loader.Load(ctx, "a"); err != context.Canceled {
+		t.Fatal("expected context.Canceled", err)
+	}
+	if _, err := loader.Load(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if events := observer.take(); events != "created, enqueued a, delivered a context canceled, enqueued b, dispatched 1 timelimit, fetched 1 0, delivered b <nil>" {
+		t.Fatal("wrong events:", events)
+	}
+}
@@ -0,0 +1,79 @@
+package dataloadgen
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Registry lazily creates named loaders. Loaders are registered once with Register and a fresh set
+// of them is installed into each request's context with Middleware or NewContext.
+type Registry struct {
+	factories map[string]func() any
+
+	// set only on the per request copies of the registry
+	loaders map[string]any
+	mu      sync.Mutex
+}
+
+type registryKey struct{}
+
+// NewRegistry creates a registry with no loaders
+func NewRegistry() *Registry {
+	return &Registry{factories: map[string]func() any{}}
+}
+
+// Register adds a named loader to the registry. newLoader is called at most once per request, the
+// first time the loader is retrieved with For. Register must not be called once the registry is in use.
+func Register[KeyT comparable, ValueT any](r *Registry, name string, newLoader func() *Loader[KeyT, ValueT]) {
+	r.factories[name] = func() any { return newLoader() }
+}
+
+// NewContext returns a copy of ctx that carries a fresh set of the registry's loaders
+func (r *Registry) NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, registryKey{}, &Registry{
+		factories: r.factories,
+		loaders:   map[string]any{},
+	})
+}
+
+// Middleware installs a fresh set of the registry's loaders into the context of every request
+func (r *Registry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(r.NewContext(req.Context())))
+	})
+}
+
+// For returns the loader registered under name from the registry in ctx, creating it if this is
+// the first time it's used. It panics if ctx has no registry, if no loader is registered under name
+// or if the loader has different key or value types.
+func For[KeyT comparable, ValueT any](ctx context.Context, name string) *Loader[KeyT, ValueT] {
+	r, ok := ctx.Value(registryKey{}).(*Registry)
+	if !ok {
+		panic("dataloadgen: no registry in context")
+	}
+
+	loader := r.loader(name)
+	typed, ok := loader.(*Loader[KeyT, ValueT])
+	if !ok {
+		panic(fmt.Sprintf("dataloadgen: loader %q is a %T, not a %T", name, loader, typed))
+	}
+	return typed
+}
+
+// loader returns the loader registered under name, creating it if this is the first time it's used
+func (r *Registry) loader(name string) any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	loader, ok := r.loaders[name]
+	if !ok {
+		newLoader, registered := r.factories[name]
+		if !registered {
+			panic(fmt.Sprintf("dataloadgen: no loader registered as %q", name))
+		}
+		loader = newLoader()
+		r.loaders[name] = loader
+	}
+	return loader
+}
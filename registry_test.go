@@ -0,0 +1,117 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+func TestRegistryMiddleware(t *testing.T) {
+	var created int32
+	registry := dataloadgen.NewRegistry()
+	dataloadgen.Register(registry, "numbers", func() *dataloadgen.Loader[string, int] {
+		atomic.AddInt32(&created, 1)
+		return dataloadgen.NewLoader(func(_ context.Context, keys []string) (ret []int, errs []error) {
+			for _, key := range keys {
+				num, err := strconv.Atoi(key)
+				ret = append(ret, num)
+				errs = append(errs, err)
+			}
+			return
+		})
+	})
+
+	var loaders []*dataloadgen.Loader[string, int]
+	handler := registry.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loader := dataloadgen.For[string, int](r.Context(), "numbers")
+		if loader != dataloadgen.For[string, int](r.Context(), "numbers") {
+			t.Error("loader not reused within the request")
+		}
+		loaders = append(loaders, loader)
+		n, err := loader.Load(r.Context(), r.URL.Query().Get("n"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, n)
+	}))
+
+	for _, n := range []string{"1", "2"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?n="+n, nil))
+		body, _ := io.ReadAll(rec.Body)
+		if string(body) != n {
+			t.Fatalf("wrong response: %q", body)
+		}
+	}
+	if created != 2 || loaders[0] == loaders[1] {
+		t.Fatal("loaders not created per request")
+	}
+}
+
+func TestRegistryForPanics(t *testing.T) {
+	registry := dataloadgen.NewRegistry()
+	dataloadgen.Register(registry, "numbers", func() *dataloadgen.Loader[string, int] {
+		return dataloadgen.NewLoader(func(_ context.Context, keys []string) ([]int, []error) {
+			return make([]int, len(keys)), nil
+		})
+	})
+	ctx := registry.NewContext(context.Background())
+
+	for name, f := range map[string]func(){
+		"no registry":  func() { dataloadgen.For[string, int](context.Background(), "numbers") },
+		"unregistered": func() { dataloadgen.For[string, int](ctx, "letters") },
+		"wrong types":  func() { dataloadgen.For[int, int](ctx, "numbers") },
+	} {
+		f := f
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected panic")
+				}
+			}()
+			f()
+		})
+	}
+}
+
+func TestRegistryFactoryPanic(t *testing.T) {
+	registry := dataloadgen.NewRegistry()
+	dataloadgen.Register(registry, "broken", func() *dataloadgen.Loader[string, int] {
+		panic("factory panic")
+	})
+	dataloadgen.Register(registry, "numbers", func() *dataloadgen.Loader[string, int] {
+		return dataloadgen.NewLoader(func(_ context.Context, keys []string) ([]int, []error) {
+			return make([]int, len(keys)), nil
+		})
+	})
+	ctx := registry.NewContext(context.Background())
+
+	func() {
+		defer func() {
+			if recover() != "factory panic" {
+				t.Fatal("expected the factory's panic")
+			}
+		}()
+		dataloadgen.For[string, int](ctx, "broken")
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		dataloadgen.For[string, int](ctx, "numbers")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("registry still locked after a factory panicked")
+	}
+}
@@ -0,0 +1,187 @@
+package dataloadgen
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// WithCoalesce makes a Writer merge writes to the same key that end up in the same batch into one,
+// using merge to combine the inputs in the order they were written. All of the merged writes get the
+// same result. InputT must match the input type of the writer.
+func WithCoalesce[InputT any](merge func(prev, next InputT) InputT) Option {
+	return func(l *loaderConfig) {
+		l.coalesce = merge
+	}
+}
+
+// Writer batches writes, like marking items as read or incrementing counters. It doesn't cache
+// anything: every write is passed to the write function. It honours WithWait, WithBatchCapacity,
+// WithFetchContext, WithPanicOnContractViolation, WithPanicHandler and WithCoalesce, and ignores the
+// other options.
+type Writer[KeyT comparable, InputT, OutputT any] struct {
+	// this method performs the writes, returning outputs and errors in the same order as keys and inputs
+	write func(ctx context.Context, keys []KeyT, inputs []InputT) ([]OutputT, []error)
+
+	*loaderConfig
+
+	// merges inputs for the same key, nil if writes aren't coalesced
+	merge func(prev, next InputT) InputT
+
+	// INTERNAL
+
+	// the current batch. writes will continue to be collected until timeout is hit,
+	// then everything will be sent to the write method and out to the listeners
+	batch *writerBatch[KeyT, InputT, OutputT]
+
+	// mutex to prevent races
+	mu sync.Mutex
+}
+
+type writerBatch[KeyT comparable, InputT, OutputT any] struct {
+	keys   []KeyT
+	inputs []InputT
+	// the position of each key, only used when coalescing
+	positions map[KeyT]int
+
+	outputs []OutputT
+	errs    []error
+
+	dispatched   bool
+	done         chan struct{}
+	firstContext context.Context
+	callers      callerContexts
+}
+
+// NewWriter creates a new Writer given a write function that receives all of the writes of a batch
+func NewWriter[KeyT comparable, InputT, OutputT any](write func(ctx context.Context, keys []KeyT, inputs []InputT) ([]OutputT, []error), options ...Option) *Writer[KeyT, InputT, OutputT] {
+	config := newLoaderConfig(options)
+	w := &Writer[KeyT, InputT, OutputT]{
+		write:        write,
+		loaderConfig: config,
+	}
+	if config.coalesce != nil {
+		merge, ok := config.coalesce.(func(prev, next InputT) InputT)
+		if !ok {
+			panic(fmt.Sprintf("dataloadgen: WithCoalesce was given a %T for a writer with %T inputs", config.coalesce, *new(InputT)))
+		}
+		w.merge = merge
+	}
+	return w
+}
+
+// Write adds a write to the current batch and waits for its result.
+// If ctx is done first, ctx.Err() is returned, but the write is still performed.
+func (w *Writer[KeyT, InputT, OutputT]) Write(ctx context.Context, key KeyT, input InputT) (OutputT, error) {
+	return w.WriteThunk(ctx, key, input)()
+}
+
+// WriteThunk adds a write to the current batch and returns a function that when called will block
+// waiting for its result.
+func (w *Writer[KeyT, InputT, OutputT]) WriteThunk(ctx context.Context, key KeyT, input InputT) func() (OutputT, error) {
+	w.mu.Lock()
+	b := w.startBatch(ctx)
+	if w.fetchContext == MergedContext {
+		b.callers.add(ctx)
+	}
+	pos, ok := b.positions[key]
+	if ok {
+		b.inputs[pos] = w.merge(b.inputs[pos], input)
+	} else {
+		pos = len(b.keys)
+		b.keys = append(b.keys, key)
+		b.inputs = append(b.inputs, input)
+		if w.merge != nil {
+			b.positions[key] = pos
+		}
+		if w.maxBatch != 0 && len(b.keys) >= w.maxBatch {
+			w.dispatch(b)
+			go w.writeBatch(b)
+		}
+	}
+	w.mu.Unlock()
+
+	return func() (OutputT, error) {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			var zero OutputT
+			return zero, ctx.Err()
+		}
+		w.handleErr(ctx, b.errs[pos])
+		return b.outputs[pos], b.errs[pos]
+	}
+}
+
+// startBatch returns the current batch, starting a new one if there isn't one. It must be called with the mutex held.
+func (w *Writer[KeyT, InputT, OutputT]) startBatch(ctx context.Context) *writerBatch[KeyT, InputT, OutputT] {
+	if w.batch != nil {
+		return w.batch
+	}
+	b := &writerBatch[KeyT, InputT, OutputT]{
+		done:         make(chan struct{}),
+		firstContext: ctx,
+	}
+	b.callers.add(ctx)
+	if w.merge != nil {
+		b.positions = map[KeyT]int{}
+	}
+	w.batch = b
+	go func() {
+		time.Sleep(w.wait)
+		w.mu.Lock()
+
+		// we must have hit a batch limit and are already finalizing this batch
+		if b.dispatched {
+			w.mu.Unlock()
+			return
+		}
+
+		w.dispatch(b)
+		w.mu.Unlock()
+
+		w.writeBatch(b)
+	}()
+	return b
+}
+
+// dispatch stops the batch from accepting more writes. It must be called with the mutex held.
+func (w *Writer[KeyT, InputT, OutputT]) dispatch(b *writerBatch[KeyT, InputT, OutputT]) {
+	b.dispatched = true
+	if w.batch == b {
+		w.batch = nil
+	}
+}
+
+// writeBatch calls write for a dispatched batch and hands the results out to the callers
+func (w *Writer[KeyT, InputT, OutputT]) writeBatch(b *writerBatch[KeyT, InputT, OutputT]) {
+	var ctx context.Context
+	var release func()
+	if w.fetchContext == MergedContext {
+		ctx, release = mergeContexts(b.callers.ctxs)
+	} else {
+		ctx, release = context.WithCancel(b.firstContext)
+	}
+	outputs, errs := w.safeWrite(ctx, b.keys, b.inputs)
+	release()
+
+	result := splitResults(len(b.keys), outputs, errs)
+	b.outputs = make([]OutputT, len(b.keys))
+	b.errs = make([]error, len(b.keys))
+	for i := range b.keys {
+		b.outputs[i], b.errs[i] = result(i)
+	}
+	close(b.done)
+}
+
+func (w *Writer[KeyT, InputT, OutputT]) safeWrite(ctx context.Context, keys []KeyT, inputs []InputT) (outputs []OutputT, errs []error) {
+	defer func() {
+		panicValue := recover()
+		if panicValue != nil {
+			errs = []error{&PanicError{Value: panicValue, Stack: debug.Stack()}}
+		}
+	}()
+	return w.write(ctx, keys, inputs)
+}
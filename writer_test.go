@@ -0,0 +1,115 @@
+package dataloadgen_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikstrous/dataloadgen"
+)
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	var batches []string
+	var mu sync.Mutex
+	w := dataloadgen.NewWriter(func(_ context.Context, keys []string, inputs []int) ([]int, []error) {
+		mu.Lock()
+		batches = append(batches, fmt.Sprint(keys, inputs))
+		mu.Unlock()
+		outputs := make([]int, len(keys))
+		errs := make([]error, len(keys))
+		for i, input := range inputs {
+			if input < 0 {
+				errs[i] = errors.New("negative input")
+			}
+			outputs[i] = input * 10
+		}
+		return outputs, errs
+	},
+		dataloadgen.WithWait(5*time.Millisecond),
+		dataloadgen.WithBatchCapacity(3),
+	)
+
+	thunks := []func() (int, error){
+		w.WriteThunk(ctx, "a", 1),
+		w.WriteThunk(ctx, "a", 2),
+		w.WriteThunk(ctx, "b", -1),
+		w.WriteThunk(ctx, "c", 3),
+	}
+	var results []string
+	for _, thunk := range thunks {
+		output, err := thunk()
+		results = append(results, fmt.Sprint(output, err))
+	}
+	if fmt.Sprint(results) != "[10 <nil> 20 <nil> -10 negative input 30 <nil>]" {
+		t.Fatal("wrong results", results)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 || batches[0] != "[a a b] [1 2 -1]" || batches[1] != "[c] [3]" {
+		t.Fatal("wrong batches", batches)
+	}
+}
+
+func TestWriterCoalesce(t *testing.T) {
+	ctx := context.Background()
+	var batches []string
+	var mu sync.Mutex
+	w := dataloadgen.NewWriter(func(_ context.Context, keys []string, increments []int) ([]int, []error) {
+		mu.Lock()
+		batches = append(batches, fmt.Sprint(keys, increments))
+		mu.Unlock()
+		return increments, nil
+	},
+		dataloadgen.WithCoalesce(func(prev, next int) int { return prev + next }),
+	)
+
+	thunk1 := w.WriteThunk(ctx, "a", 1)
+	thunk2 := w.WriteThunk(ctx, "b", 1)
+	thunk3 := w.WriteThunk(ctx, "a", 2)
+	for i, thunk := range []func() (int, error){thunk1, thunk2, thunk3} {
+		output, err := thunk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []int{3, 1, 3}[i]; output != expected {
+			t.Fatalf("wrong output %d, expected %d", output, expected)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 1 || batches[0] != "[a b] [3 1]" {
+		t.Fatal("wrong batches", batches)
+	}
+}
+
+func TestWriterPanic(t *testing.T) {
+	w := dataloadgen.NewWriter(func(_ context.Context, keys []string, inputs []int) ([]int, []error) {
+		panic("write panic")
+	})
+	_, err := w.Write(context.Background(), "a", 1)
+	var panicErr *dataloadgen.PanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "write panic" {
+		t.Fatal("wrong error", err)
+	}
+}
+
+func TestWriterUncomparableCallerContexts(t *testing.T) {
+	w := dataloadgen.NewWriter(func(_ context.Context, keys []string, inputs []int) ([]int, []error) {
+		return inputs, nil
+	}, dataloadgen.WithWait(5*time.Millisecond))
+
+	thunk1 := w.WriteThunk(taggedContext{context.Background(), []string{"a"}}, "a", 1)
+	thunk2 := w.WriteThunk(taggedContext{context.Background(), []string{"b"}}, "b", 2)
+	if v, err := thunk1(); v != 1 || err != nil {
+		t.Fatal("wrong result", v, err)
+	}
+	if v, err := thunk2(); v != 2 || err != nil {
+		t.Fatal("wrong result", v, err)
+	}
+}